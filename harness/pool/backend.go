@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -99,14 +101,19 @@ type serverInfo struct {
 type statusResponse struct {
 	Status  string     `json:"status"`
 	MatchID string     `json:"matchId"`
+	Team    int        `json:"team"`
 	Server  serverInfo `json:"server"`
+	Reason  string     `json:"reason"`
 }
 
-func Matchmaking(id int) (*MatchInfo, error) {
+func Matchmaking(id int, pings map[string]int, roles []string) (*MatchInfo, error) {
 	// 1. Join matchmaking
 	joinURL := getGatewayURL() + "/matchmaking/join"
-	requestBody, err := json.Marshal(map[string]string{
-		"id": strconv.Itoa(id),
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"id":    strconv.Itoa(id),
+		"queue": getQueue(),
+		"pings": pings,
+		"roles": roles, // only used by role queues
 	})
 	if err != nil {
 		return nil, err
@@ -118,6 +125,16 @@ func Matchmaking(id int) (*MatchInfo, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusForbidden {
+		// Locked out for dodging or leaving games
+		var penaltyErr struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&penaltyErr) == nil && penaltyErr.Error != "" {
+			return nil, fmt.Errorf("matchmaking join rejected (%s): %s", penaltyErr.Error, penaltyErr.Message)
+		}
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("matchmaking join failed with status code: %d", resp.StatusCode)
 	}
@@ -132,20 +149,42 @@ func Matchmaking(id int) (*MatchInfo, error) {
 		return nil, fmt.Errorf("received empty ticketId")
 	}
 
-	// 2. Poll for status
+	// 2. Wait for the match
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if getStatusMode() == "stream" {
+		return streamStatus(ctx, id, ticketID)
+	}
+	return pollStatus(ctx, id, ticketID)
+}
+
+// getQueue returns the queue players join; empty selects the default queue.
+func getQueue() string {
+	return os.Getenv("MATCHMAKING_QUEUE")
+}
+
+// getStatusMode returns how Matchmaking waits for a ticket: "poll" asks for the
+// status every second, "stream" keeps a Server-Sent Events stream open.
+func getStatusMode() string {
+	if mode := os.Getenv("MATCHMAKING_STATUS_MODE"); mode != "" {
+		return mode
+	}
+	return "poll"
+}
+
+func pollStatus(ctx context.Context, id int, ticketID string) (*MatchInfo, error) {
 	statusURL := getGatewayURL() + "/matchmaking/status"
+	answered := ""
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	// Timeout after 60 seconds
-	timeout := time.After(60 * time.Second)
-
 	for {
 		select {
-		case <-timeout:
+		case <-ctx.Done():
 			return nil, fmt.Errorf("matchmaking timed out for ticket %s", ticketID)
 		case <-ticker.C:
-			req, err := http.NewRequest("GET", statusURL, nil)
+			req, err := http.NewRequestWithContext(ctx, "GET", statusURL, nil)
 			if err != nil {
 				return nil, err
 			}
@@ -171,26 +210,153 @@ func Matchmaking(id int) (*MatchInfo, error) {
 				continue
 			}
 
-			if statusResp.Status == "matched" {
-				return &MatchInfo{
-					MatchID:   statusResp.MatchID,
-					GameID:    statusResp.Server.GameID,
-					ServerURL: statusResp.Server.URL,
-				}, nil
-			} else if statusResp.Status == "cancelled" {
-				return nil, fmt.Errorf("matchmaking ticket cancelled")
+			if statusResp.Status == "pending_accept" && statusResp.MatchID != answered {
+				answered = statusResp.MatchID
+				// A failed answer lets the ready check time out, like an AFK player
+				acceptMatch(ctx, id)
 			}
-			// if "searching", continue polling
+
+			if info, done, err := statusResult(statusResp); done {
+				return info, err
+			}
+			// if "searching" or waiting for others to accept, continue polling
 		}
 	}
 }
 
-func ConnectToGameServer(ctx context.Context, info *MatchInfo) error {
+func streamStatus(ctx context.Context, id int, ticketID string) (*MatchInfo, error) {
+	streamURL := getGatewayURL() + "/matchmaking/stream"
+	req, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("ticketId", ticketID)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("matchmaking timed out for ticket %s", ticketID)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("matchmaking stream failed with status code: %d", resp.StatusCode)
+	}
+
+	// Only the data lines matter; event names and keep-alive comments are skipped
+	answered := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var statusResp statusResponse
+		if err := json.Unmarshal([]byte(data), &statusResp); err != nil {
+			continue
+		}
+		if statusResp.Status == "pending_accept" && statusResp.MatchID != answered {
+			answered = statusResp.MatchID
+			acceptMatch(ctx, id)
+		}
+		if info, done, err := statusResult(statusResp); done {
+			return info, err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("matchmaking timed out for ticket %s", ticketID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("matchmaking stream closed for ticket %s", ticketID)
+}
+
+// statusResult reports whether a ticket status ends matchmaking, and with
+// which outcome.
+func statusResult(statusResp statusResponse) (*MatchInfo, bool, error) {
+	switch statusResp.Status {
+	case "matched":
+		return &MatchInfo{
+			MatchID:   statusResp.MatchID,
+			GameID:    statusResp.Server.GameID,
+			ServerURL: statusResp.Server.URL,
+			Team:      statusResp.Team,
+		}, true, nil
+	case "cancelled":
+		return nil, true, fmt.Errorf("matchmaking ticket cancelled")
+	case "failed":
+		return nil, true, fmt.Errorf("matchmaking ticket failed: %s", statusResp.Reason)
+	case "declined":
+		return nil, true, fmt.Errorf("matchmaking ticket declined: %s", statusResp.Reason)
+	case "abandoned":
+		return nil, true, fmt.Errorf("matchmaking ticket abandoned: %s", statusResp.Reason)
+	}
+	return nil, false, nil
+}
+
+// afkRate is the share of ready checks a player misses, as if away from the keyboard.
+const afkRate = 0.02
+
+// acceptMatch answers a ready check after a human reaction time. AFK players
+// never answer, so their ready check times out.
+func acceptMatch(ctx context.Context, id int) error {
+	if rand.Float64() < afkRate {
+		return nil
+	}
+
+	select {
+	case <-time.After(time.Duration(500+rand.IntN(2500)) * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"id":     strconv.Itoa(id),
+		"accept": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", getGatewayURL()+"/matchmaking/accept", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("accepting match failed with status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// leaveRate is the share of games a player quits before the end.
+const leaveRate = 0.03
+
+func ConnectToGameServer(ctx context.Context, id int, skill float64, info *MatchInfo) error {
 	// The Orchestrator returns the full WebSocket URL now.
 	url := info.ServerURL
 	if url == "" {
 		return fmt.Errorf("server url is empty")
 	}
+	// Lets the game server report the player if they leave early, request a
+	// replacement for their team, and simulate their performance from their
+	// true skill
+	url += "?playerId=" + strconv.Itoa(id) + "&team=" + strconv.Itoa(info.Team) + "&skill=" + strconv.FormatFloat(skill, 'f', 0, 64)
 
 	c, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
 	if err != nil {
@@ -213,11 +379,19 @@ func ConnectToGameServer(ctx context.Context, info *MatchInfo) error {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
+	var leave <-chan time.Time
+	if rand.Float64() < leaveRate {
+		leave = time.After(time.Duration(2+rand.IntN(8)) * time.Second)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			return ctx.Err()
+		case <-leave:
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return nil
 		case <-done:
 			return nil
 		case <-ticker.C:
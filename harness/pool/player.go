@@ -13,6 +13,7 @@ type MatchInfo struct {
 	MatchID   string `json:"match_id"`
 	GameID    string `json:"game_id"`
 	ServerURL string `json:"server_url"`
+	Team      int    `json:"team"`
 }
 
 type Player struct {
@@ -21,6 +22,10 @@ type Player struct {
 	playerCnt *int64
 	cancel    context.CancelFunc
 	matchInfo *MatchInfo
+	home      homeRegion
+	lastMile  int      // the player's own latency added to every ping
+	roles     []string // preferred roles in role queues
+	skill     float64  // true skill the game servers simulate performances from; matchmaking only sees results
 }
 
 func newPlayer(id int, playerCnt *int64, cancel context.CancelFunc) *Player {
@@ -30,6 +35,10 @@ func newPlayer(id int, playerCnt *int64, cancel context.CancelFunc) *Player {
 		scenario:  make(chan Scenario),
 		playerCnt: playerCnt,
 		cancel:    cancel,
+		home:      randomHomeRegion(),
+		lastMile:  5 + rand.IntN(40),
+		roles:     randomRoles(),
+		skill:     1500 + rand.NormFloat64()*300,
 	}
 }
 
@@ -0,0 +1,39 @@
+package pool
+
+import "math/rand/v2"
+
+// homeRegion is where a simulated player lives: the share of players living
+// there and the typical round trip in milliseconds to each server region.
+type homeRegion struct {
+	name  string
+	share float64
+	pings map[string]int
+}
+
+var homeRegions = []homeRegion{
+	{"eu-west", 0.45, map[string]int{"eu-west": 25, "us-east": 85, "asia-east": 230}},
+	{"us-east", 0.35, map[string]int{"eu-west": 85, "us-east": 25, "asia-east": 180}},
+	{"asia-east", 0.20, map[string]int{"eu-west": 230, "us-east": 180, "asia-east": 30}},
+}
+
+// randomHomeRegion picks a home region weighted by its share of players.
+func randomHomeRegion() homeRegion {
+	r := rand.Float64()
+	for _, h := range homeRegions {
+		if r < h.share {
+			return h
+		}
+		r -= h.share
+	}
+	return homeRegions[len(homeRegions)-1]
+}
+
+// measurePings simulates a ping to every region: the route's base latency,
+// plus the player's own last-mile latency, plus some jitter per measurement.
+func measurePings(home homeRegion, lastMile int) map[string]int {
+	pings := make(map[string]int, len(home.pings))
+	for region, base := range home.pings {
+		pings[region] = base + lastMile + rand.IntN(10)
+	}
+	return pings
+}
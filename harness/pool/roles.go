@@ -0,0 +1,44 @@
+package pool
+
+import "math/rand/v2"
+
+// roleShares is how popular each role is among simulated players. Duelists
+// are over-represented, as in most games, so the other roles run short.
+var roleShares = []struct {
+	name  string
+	share float64
+}{
+	{"duelist", 0.40},
+	{"controller", 0.20},
+	{"sentinel", 0.20},
+	{"initiator", 0.20},
+}
+
+// fillRate is the share of players who queue as fill.
+const fillRate = 0.1
+
+// randomRoles picks the roles a player prefers: fill, or one or two roles
+// weighted by popularity.
+func randomRoles() []string {
+	if rand.Float64() < fillRate {
+		return []string{"fill"}
+	}
+	roles := []string{randomRole()}
+	if rand.IntN(2) == 0 {
+		if second := randomRole(); second != roles[0] {
+			roles = append(roles, second)
+		}
+	}
+	return roles
+}
+
+func randomRole() string {
+	r := rand.Float64()
+	for _, role := range roleShares {
+		if r < role.share {
+			return role.name
+		}
+		r -= role.share
+	}
+	return roleShares[len(roleShares)-1].name
+}
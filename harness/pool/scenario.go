@@ -40,7 +40,7 @@ type MatchmakingScenario struct{}
 
 func (MatchmakingScenario) Run(ctx context.Context, p *Player, e ScenarioEmitter) error {
 	fmt.Printf("[player %d] matchmaking\n", p.id)
-	info, err := Matchmaking(p.id)
+	info, err := Matchmaking(p.id, measurePings(p.home, p.lastMile), p.roles)
 	if err != nil {
 		return err
 	}
@@ -68,7 +68,7 @@ func (InGameScenario) Run(ctx context.Context, p *Player, e ScenarioEmitter) err
 	if p.matchInfo == nil {
 		return fmt.Errorf("player %d has no match info", p.id)
 	}
-	return ConnectToGameServer(ctx, p.matchInfo)
+	return ConnectToGameServer(ctx, p.id, p.skill, p.matchInfo)
 }
 
 func (InGameScenario) Name() string {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// callbackTokenHeader carries the game's token on every callback, since the
+// callbacks share the public /game/{id}/ path with player connections.
+const callbackTokenHeader = "X-Game-Token"
+
+// callbackKey signs the callback tokens. CALLBACK_KEY sets it; without it,
+// every process picks its own, and servers adopted after a restart can no
+// longer call back.
+var callbackKey []byte
+
+// initCallbackKey sets callbackKey from the given secret, or to random bytes.
+func initCallbackKey(secret string) error {
+	if secret != "" {
+		callbackKey = []byte(secret)
+		return nil
+	}
+	callbackKey = make([]byte, 32)
+	if _, err := rand.Read(callbackKey); err != nil {
+		return fmt.Errorf("generating callback key: %w", err)
+	}
+	return nil
+}
+
+// callbackURL is where the game server of a game reaches the given callback.
+func callbackURL(gameID, callback string) string {
+	return fmt.Sprintf("http://%s:8080/game/%s/%s", callbackHost, gameID, callback)
+}
+
+// callbackToken is the secret the game server of a game sends with its
+// callbacks. It is only valid for that game.
+func callbackToken(gameID string) string {
+	mac := hmac.New(sha256.New, callbackKey)
+	mac.Write([]byte(gameID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorizeCallback rejects callbacks that do not carry the game's token.
+func authorizeCallback(w http.ResponseWriter, r *http.Request, gameID string) bool {
+	token := r.Header.Get(callbackTokenHeader)
+	if token == "" {
+		http.Error(w, "Game token required", http.StatusUnauthorized)
+		return false
+	}
+	if !hmac.Equal([]byte(token), []byte(callbackToken(gameID))) {
+		http.Error(w, "Invalid game token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
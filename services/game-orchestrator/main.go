@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,21 +12,39 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"game-orchestrator/metrics"
+	"game-orchestrator/provisioner"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
-	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
 type CreateGameRequest struct {
-	GameID string `json:"game_id"`
+	GameID   string `json:"game_id"`
+	Duration string `json:"duration"`      // e.g. "30s", passed to the game server
+	Region   string `json:"region"`        // region the players are closest to
+	Map      string `json:"map,omitempty"` // chosen in lobbies, passed to the game server
+	// Players and their teams, passed on as JSON
+	Players []GamePlayer `json:"players,omitempty"`
+	// Bots the game server simulates, passed on as JSON
+	Bots []GameBot `json:"bots,omitempty"`
+}
+
+type GamePlayer struct {
+	ID   string `json:"id"`
+	Team int    `json:"team"`
+}
+
+type GameBot struct {
+	ID    string  `json:"id"`
+	Team  int     `json:"team"`
+	Skill float64 `json:"skill"`
 }
 
 type CreateGameResponse struct {
@@ -33,33 +53,114 @@ type CreateGameResponse struct {
 }
 
 var (
-	dockerClient *client.Client
-	networkName  string
-	imageName    string
+	backend        provisioner.Provisioner
+	callbackHost   string
+	matchmakingURL string
+	warmServers    *warmPool
 )
 
 func main() {
-	var err error
-	dockerClient, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		log.Fatalf("Error creating docker client: %v", err)
+	// Environment configuration
+	matchmakingURL = os.Getenv("MATCHMAKING_URL")
+	if matchmakingURL == "" {
+		matchmakingURL = "http://matchmaking:8081"
 	}
-	defer dockerClient.Close()
+	callbackHost = os.Getenv("CALLBACK_HOST")
+
+	switch kind := os.Getenv("PROVISIONER"); kind {
+	case "", "docker":
+		networkName := os.Getenv("DOCKER_NETWORK_NAME")
+		if networkName == "" {
+			// Default to bridge network for dind
+			networkName = "bridge"
+		}
+		imageName := os.Getenv("GAME_SERVER_IMAGE")
+		if imageName == "" {
+			imageName = "game-server:latest"
+		}
+		docker, err := provisioner.NewDocker(imageName, networkName)
+		if err != nil {
+			log.Fatalf("Error creating docker client: %v", err)
+		}
+		defer docker.Close()
+		backend = docker
 
-	// Environment configuration
-	networkName = os.Getenv("DOCKER_NETWORK_NAME")
-	if networkName == "" {
-		// Default to bridge network for dind
-		networkName = "bridge"
+		// Game servers live on the inner Docker network and cannot resolve the
+		// compose services, but they can reach us through their network's gateway
+		if callbackHost == "" {
+			callbackHost, err = docker.Gateway(context.Background())
+			if err != nil {
+				log.Fatalf("Error finding the game network's gateway, set CALLBACK_HOST: %v", err)
+			}
+		}
+	case "local":
+		// Game servers run next to us without a container
+		binary := os.Getenv("GAME_SERVER_BIN")
+		if binary == "" {
+			binary = "game-server"
+		}
+		backend = provisioner.NewLocal(binary)
+	case "fake":
+		// Nothing runs; connections go to FAKE_SERVER_ADDR if set
+		backend = provisioner.NewFake(os.Getenv("FAKE_SERVER_ADDR"))
+	default:
+		log.Fatalf("Unknown PROVISIONER %q, use docker, local or fake", kind)
+	}
+	if callbackHost == "" {
+		callbackHost = "127.0.0.1"
+	}
+	if err := initCallbackKey(os.Getenv("CALLBACK_KEY")); err != nil {
+		log.Fatal(err)
+	}
+
+	if timeout := os.Getenv("READY_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid READY_TIMEOUT %q", timeout)
+		}
+		readyTimeout = d
 	}
-	imageName = os.Getenv("GAME_SERVER_IMAGE")
-	if imageName == "" {
-		imageName = "game-server:latest"
+
+	// The registry of games is written through to Redis if there is one
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		games = newGameRegistry(redis.NewClient(&redis.Options{Addr: addr}))
+	}
+	go games.runPruner(context.Background())
+
+	// Find the game servers an earlier process left running
+	runID = uuid.New().String()[:8]
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RECONCILE_INTERVAL %q", interval)
+		}
+		reconcileInterval = d
+	}
+	if err := games.load(context.Background()); err != nil {
+		log.Printf("Error loading games: %v", err)
+	}
+	if err := reconcile(context.Background()); err != nil {
+		log.Printf("Error reconciling game servers: %v", err)
+	}
+	go runReconciler(context.Background())
+
+	// Pre-started game servers take container startup off the /create path
+	if size := os.Getenv("WARM_POOL_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid WARM_POOL_SIZE %q", size)
+		}
+		if n > 0 {
+			warmServers = newWarmPool(n)
+			go warmServers.run(context.Background())
+		}
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/create", handleCreateGame)
 	http.HandleFunc("/game/", handleGameProxy)
+	http.HandleFunc("/games", handleGames)
+	http.HandleFunc("/games/", handleGame)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -85,69 +186,46 @@ func handleCreateGame(w http.ResponseWriter, r *http.Request) {
 		json.Unmarshal(body, &req)
 	}
 
-	gameID := req.GameID
-	if gameID == "" {
-		gameID = uuid.New().String()
-	}
-
-	containerName := fmt.Sprintf("game-%s", gameID)
-
-	// Configure the container
-	config := &container.Config{
-		Image: imageName,
-		Env: []string{
-			fmt.Sprintf("GAME_ID=%s", gameID),
-			"GAME_DURATION=30s", // Default duration
-		},
-		ExposedPorts: nat.PortSet{
-			"8080/tcp": struct{}{},
-		},
+	if req.GameID == "" {
+		req.GameID = uuid.New().String()
 	}
+	gameID := req.GameID
 
-	hostConfig := &container.HostConfig{
-		AutoRemove: true, // Clean up container after it exits
+	if req.Duration == "" {
+		req.Duration = "30s" // Default duration
 	}
 
-	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			networkName: {},
-		},
+	// All servers run on this Docker host; the region is attached to the
+	// container so that a multi-host setup can pick the host by it
+	if req.Region == "" {
+		req.Region = "default"
 	}
 
 	ctx := context.Background()
 
-	// Create the container
-	resp, err := dockerClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
-	if err != nil {
-		log.Printf("Error creating container: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to create game server: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Start the container
-	if err := dockerClient.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		log.Printf("Error starting container: %v", err)
-		// Try to clean up if start fails
-		_ = dockerClient.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
-		http.Error(w, fmt.Sprintf("Failed to start game server: %v", err), http.StatusInternalServerError)
-		return
+	// Hand the game to a warm server if one is ready, start a new one otherwise
+	started := false
+	if warmServers != nil {
+		if err := warmServers.claim(ctx, req); err != nil {
+			log.Printf("No warm game server for game %s, starting one: %v", gameID, err)
+		} else {
+			started = true
+		}
 	}
-
-	metrics.OngoingMatches.Inc()
-	go func(id string) {
-		// Wait for container to exit to decrement metric
-		statusCh, errCh := dockerClient.ContainerWait(context.Background(), id, container.WaitConditionNotRunning)
-		select {
-		case err := <-errCh:
-			if err != nil {
-				log.Printf("Error waiting for container %s: %v", id, err)
+	if !started {
+		metrics.ColdStarts.Inc()
+		if err := startGameServer(ctx, req); err != nil {
+			log.Printf("Error starting game server for game %s: %v", gameID, err)
+			status := http.StatusInternalServerError
+			var failed *allocationError
+			if errors.As(err, &failed) {
+				metrics.AllocationFailures.WithLabelValues(failed.reason).Inc()
+				status = failed.status
 			}
-		case <-statusCh:
+			http.Error(w, fmt.Sprintf("Failed to start game server: %v", err), status)
+			return
 		}
-		metrics.OngoingMatches.Dec()
-	}(resp.ID)
-
-	log.Printf("Started game server container %s (%s)", containerName, resp.ID)
+	}
 
 	// Determine orchestrator hostname for the return URL
 	hostname := os.Getenv("ORCHESTRATOR_HOSTNAME")
@@ -166,6 +244,99 @@ func handleCreateGame(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// startGameServer creates and starts a new game server for the game, and
+// returns once it answers its health check. A server that does not is torn
+// down again.
+func startGameServer(ctx context.Context, req CreateGameRequest) error {
+	spec := provisioner.Spec{
+		Name: fmt.Sprintf("game-%s", req.GameID),
+		Env: []string{
+			fmt.Sprintf("GAME_ID=%s", req.GameID),
+			fmt.Sprintf("GAME_DURATION=%s", req.Duration),
+			fmt.Sprintf("GAME_REGION=%s", req.Region),
+			fmt.Sprintf("GAME_MAP=%s", req.Map),
+			fmt.Sprintf("REPORT_URL=%s", callbackURL(req.GameID, "report")),
+			fmt.Sprintf("RESULT_URL=%s", callbackURL(req.GameID, "result")),
+			fmt.Sprintf("BACKFILL_URL=%s", callbackURL(req.GameID, "backfill")),
+			fmt.Sprintf("GAME_TOKEN=%s", callbackToken(req.GameID)),
+		},
+		Labels: serverLabels(map[string]string{
+			"region":      req.Region,
+			labelGame:     req.GameID,
+			labelDuration: req.Duration,
+		}),
+	}
+	if len(req.Players) > 0 {
+		players, _ := json.Marshal(req.Players)
+		spec.Env = append(spec.Env, fmt.Sprintf("GAME_PLAYERS=%s", players))
+	}
+	if len(req.Bots) > 0 {
+		bots, _ := json.Marshal(req.Bots)
+		spec.Env = append(spec.Env, fmt.Sprintf("GAME_BOTS=%s", bots))
+	}
+
+	id, err := backend.Create(ctx, spec)
+	if err != nil {
+		return &allocationError{failCreate, http.StatusInternalServerError, fmt.Errorf("creating game server: %w", err)}
+	}
+	games.add(GameSession{
+		ID:          req.GameID,
+		ContainerID: id,
+		State:       StateStarting,
+		Region:      req.Region,
+		Duration:    req.Duration,
+		StartedAt:   time.Now(),
+		Players:     req.Players,
+		Bots:        req.Bots,
+		watched:     true,
+	})
+
+	if err := backend.Start(ctx, id); err != nil {
+		// Try to clean up if start fails
+		_ = backend.Stop(ctx, id)
+		games.finish(req.GameID, -1)
+		return &allocationError{failStart, http.StatusInternalServerError, fmt.Errorf("starting game server: %w", err)}
+	}
+
+	// Players connect as soon as we answer, so the server has to listen by then
+	inst, err := backend.Inspect(ctx, id)
+	if err == nil {
+		err = waitHealthy(ctx, inst.Addr, readyTimeout)
+	}
+	if err != nil {
+		_ = backend.Stop(ctx, id)
+		games.finish(req.GameID, -1)
+		return &allocationError{failNotReady, http.StatusServiceUnavailable, fmt.Errorf("game server %s did not become ready: %w", spec.Name, err)}
+	}
+
+	games.update(req.GameID, func(g *GameSession) {
+		g.State = StateReady
+		g.Address = inst.Addr
+	})
+
+	metrics.OngoingMatches.Inc()
+	go func(id string) {
+		// Wait for the game server to exit to decrement metric
+		code := waitForExit(id)
+		games.finish(req.GameID, code)
+		metrics.OngoingMatches.Dec()
+	}(id)
+
+	log.Printf("Started game server %s (%s) in region %s", spec.Name, id, req.Region)
+	return nil
+}
+
+// waitForExit blocks until the game server stops running and returns its exit
+// code, -1 if unknown.
+func waitForExit(id string) int {
+	code, err := backend.Wait(context.Background(), id)
+	if err != nil {
+		log.Printf("Error waiting for game server %s: %v", id, err)
+		return -1
+	}
+	return code
+}
+
 func handleGameProxy(w http.ResponseWriter, r *http.Request) {
 	// Expected path: /game/{game_id}/connect
 	parts := strings.Split(r.URL.Path, "/")
@@ -176,29 +347,47 @@ func handleGameProxy(w http.ResponseWriter, r *http.Request) {
 	}
 	gameID := parts[2]
 
-	containerName := fmt.Sprintf("game-%s", gameID)
-	info, err := dockerClient.ContainerInspect(context.Background(), containerName)
-	if err != nil {
-		log.Printf("Error inspecting container %s: %v", containerName, err)
-		http.Error(w, "Game server not found", http.StatusNotFound)
+	// Callbacks come from the game's server only
+	switch parts[3] {
+	case "report":
+		if authorizeCallback(w, r, gameID) {
+			handleGameReport(w, r, gameID)
+		}
+		return
+	case "result":
+		if authorizeCallback(w, r, gameID) {
+			handleGameResult(w, r, gameID)
+		}
+		return
+	case "backfill":
+		if authorizeCallback(w, r, gameID) {
+			handleGameBackfill(w, r, gameID)
+		}
 		return
 	}
 
-	ip := info.NetworkSettings.IPAddress
-	if ip == "" {
-		for _, net := range info.NetworkSettings.Networks {
-			ip = net.IPAddress
-			break
-		}
+	name := fmt.Sprintf("game-%s", gameID)
+	inst, err := backend.Inspect(context.Background(), name)
+	if err != nil {
+		log.Printf("Error inspecting game server %s: %v", name, err)
+		http.Error(w, "Game server not found", http.StatusNotFound)
+		return
 	}
 
-	if ip == "" {
-		log.Printf("Container %s has no IP", containerName)
+	if inst.Addr == "" {
+		log.Printf("Game server %s has no address", name)
 		http.Error(w, "Game server has no IP", http.StatusInternalServerError)
 		return
 	}
 
-	targetHost := fmt.Sprintf("%s:8080", ip)
+	targetHost := inst.Addr
+
+	// The game is running once its first player connects
+	games.update(gameID, func(g *GameSession) {
+		if g.State == StateReady {
+			g.State = StateRunning
+		}
+	})
 
 	// Construct the target URL for the ReverseProxy
 	targetURL := &url.URL{
@@ -222,3 +411,105 @@ func handleGameProxy(w http.ResponseWriter, r *http.Request) {
 	// Go's ReverseProxy automatically handles WebSocket upgrades
 	proxy.ServeHTTP(w, r)
 }
+
+// handleGameReport relays an early disconnect reported by a game server to the
+// matchmaking service, which keeps the players' penalty records.
+func handleGameReport(w http.ResponseWriter, r *http.Request, gameID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report struct {
+		PlayerID string `json:"playerId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.PlayerID == "" {
+		http.Error(w, "playerId required", http.StatusBadRequest)
+		return
+	}
+
+	// The game ID comes from the path so a game server can only report its own players
+	body, _ := json.Marshal(map[string]string{
+		"gameId":   gameID,
+		"playerId": report.PlayerID,
+	})
+	resp, err := http.Post(matchmakingURL+"/internal/report", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("Error reporting player %s of game %s: %v", report.PlayerID, gameID, err)
+		http.Error(w, "Matchmaking unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	metrics.ReportedLeavers.Inc()
+	w.WriteHeader(resp.StatusCode)
+}
+
+// handleGameResult relays the final scores reported by a game server to the
+// matchmaking service, which updates the players' ratings.
+func handleGameResult(w http.ResponseWriter, r *http.Request, gameID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil || len(result.Scores) == 0 {
+		http.Error(w, "scores required", http.StatusBadRequest)
+		return
+	}
+
+	// As with reports, the game ID comes from the path
+	body, _ := json.Marshal(map[string]interface{}{
+		"gameId": gameID,
+		"scores": result.Scores,
+	})
+	resp, err := http.Post(matchmakingURL+"/internal/result", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("Error reporting result of game %s: %v", gameID, err)
+		http.Error(w, "Matchmaking unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	metrics.ReportedResults.Inc()
+	w.WriteHeader(resp.StatusCode)
+}
+
+// handleGameBackfill relays a game server's request for replacements of
+// players who left to the matchmaking service, which fills the open slots of
+// the team from its queue.
+func handleGameBackfill(w http.ResponseWriter, r *http.Request, gameID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var backfill struct {
+		Team  int `json:"team"`
+		Slots int `json:"slots"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&backfill); err != nil || backfill.Slots < 1 {
+		http.Error(w, "team and slots required", http.StatusBadRequest)
+		return
+	}
+
+	// As with reports, the game ID comes from the path
+	body, _ := json.Marshal(map[string]interface{}{
+		"gameId": gameID,
+		"team":   backfill.Team,
+		"slots":  backfill.Slots,
+	})
+	resp, err := http.Post(matchmakingURL+"/internal/backfill", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("Error requesting backfill for game %s: %v", gameID, err)
+		http.Error(w, "Matchmaking unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	metrics.BackfillRequests.Inc()
+	w.WriteHeader(resp.StatusCode)
+}
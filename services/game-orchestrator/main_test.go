@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"game-orchestrator/metrics"
+	"game-orchestrator/provisioner"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testServer stands in for the game servers of a Fake provisioner. It answers
+// /health with healthStatus, /status with gameEnd if set, and records the
+// assignments of warm servers.
+type testServer struct {
+	*httptest.Server
+	healthStatus int
+	gameEnd      time.Time
+
+	mu          sync.Mutex
+	assignments []map[string]interface{}
+}
+
+func newTestServer(t *testing.T, healthStatus int) *testServer {
+	s := &testServer{healthStatus: healthStatus}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(s.healthStatus)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if s.gameEnd.IsZero() {
+			http.Error(w, "No game assigned", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ends_at": s.gameEnd})
+	})
+	mux.HandleFunc("/assign", func(w http.ResponseWriter, r *http.Request) {
+		var a map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&a)
+		s.mu.Lock()
+		s.assignments = append(s.assignments, a)
+		s.mu.Unlock()
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// setupFake points the orchestrator at a Fake provisioner whose instances are
+// served by srv, with an empty registry. The servers left running are stopped
+// once the test is done, and their watchers are waited for, since they use the
+// globals the next test replaces.
+func setupFake(t *testing.T, srv *testServer) *provisioner.Fake {
+	fake := provisioner.NewFake(strings.TrimPrefix(srv.URL, "http://"))
+	backend = fake
+	games = newGameRegistry(nil)
+	warmServers = nil
+	runID = "test"
+	callbackHost = "127.0.0.1"
+	readyTimeout = time.Second
+	if err := initCallbackKey("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	ongoing := testutil.ToFloat64(metrics.OngoingMatches)
+	t.Cleanup(func() {
+		running, _ := fake.List(context.Background(), nil)
+		for _, inst := range running {
+			fake.Exit(inst.ID, 0)
+		}
+		waitFor(t, "the games to end", func() bool {
+			return testutil.ToFloat64(metrics.OngoingMatches) == ongoing
+		})
+	})
+	return fake
+}
+
+// waitForState waits for the game to reach the given state.
+func waitForState(t *testing.T, gameID string, state GameState) GameSession {
+	t.Helper()
+	var g GameSession
+	waitFor(t, fmt.Sprintf("game %s to be %s", gameID, state), func() bool {
+		g, _ = games.get(gameID)
+		return g.State == state
+	})
+	return g
+}
+
+// waitFor waits for the condition to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartGameServer(t *testing.T) {
+	srv := newTestServer(t, http.StatusOK)
+	fake := setupFake(t, srv)
+	ongoing := testutil.ToFloat64(metrics.OngoingMatches)
+
+	req := CreateGameRequest{GameID: "g1", Duration: "30s", Region: "eu"}
+	if err := startGameServer(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	g := waitForState(t, "g1", StateReady)
+	if g.Address != fake.Addr || g.Region != "eu" || g.Warm {
+		t.Errorf("unexpected game %+v", g)
+	}
+	inst, err := fake.Inspect(context.Background(), "game-g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inst.Running || inst.ID != g.ContainerID {
+		t.Errorf("unexpected instance %+v", inst)
+	}
+	if inst.Labels["region"] != "eu" || inst.Labels[labelGame] != "g1" || inst.Labels[labelRun] != "test" {
+		t.Errorf("unexpected labels %v", inst.Labels)
+	}
+	if !slices.Contains(inst.Env, "GAME_ID=g1") {
+		t.Errorf("no game ID in %v", inst.Env)
+	}
+	if !slices.Contains(inst.Env, "GAME_TOKEN="+callbackToken("g1")) {
+		t.Errorf("no callback token in %v", inst.Env)
+	}
+	if got := testutil.ToFloat64(metrics.OngoingMatches); got != ongoing+1 {
+		t.Errorf("%v ongoing matches, want %v", got, ongoing+1)
+	}
+
+	if err := fake.Exit(inst.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, "g1", StateEnded)
+}
+
+func TestStartGameServerNotReady(t *testing.T) {
+	srv := newTestServer(t, http.StatusServiceUnavailable)
+	fake := setupFake(t, srv)
+	readyTimeout = 200 * time.Millisecond
+
+	err := startGameServer(context.Background(), CreateGameRequest{GameID: "g1", Duration: "30s"})
+	var failed *allocationError
+	if !errors.As(err, &failed) || failed.reason != failNotReady {
+		t.Fatalf("got %v, want a %s allocation error", err, failNotReady)
+	}
+	waitForState(t, "g1", StateCrashed)
+	if _, err := fake.Inspect(context.Background(), "game-g1"); !errors.Is(err, provisioner.ErrNotFound) {
+		t.Errorf("server was not torn down: %v", err)
+	}
+}
+
+func TestGameServerExit(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		code  int
+		state GameState
+	}{
+		{"clean", 0, StateEnded},
+		{"failed", 1, StateCrashed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, http.StatusOK)
+			fake := setupFake(t, srv)
+
+			if err := startGameServer(context.Background(), CreateGameRequest{GameID: "g1", Duration: "30s"}); err != nil {
+				t.Fatal(err)
+			}
+			g := waitForState(t, "g1", StateReady)
+			if err := fake.Exit(g.ContainerID, tt.code); err != nil {
+				t.Fatal(err)
+			}
+
+			g = waitForState(t, "g1", tt.state)
+			if g.ExitCode == nil || *g.ExitCode != tt.code || g.EndedAt == nil {
+				t.Errorf("unexpected game %+v", g)
+			}
+		})
+	}
+}
@@ -11,8 +11,66 @@ var (
 			Help: "Number of ongoing matches managed by the orchestrator",
 		},
 	)
+	ReportedLeavers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_reported_leavers_total",
+			Help: "Number of early disconnects reported by game servers",
+		},
+	)
+	ReportedResults = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_reported_results_total",
+			Help: "Number of game results reported by game servers",
+		},
+	)
+	BackfillRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_backfill_requests_total",
+			Help: "Number of backfill requests filed by game servers that lost players",
+		},
+	)
+	WarmPoolSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "game_orchestrator_warm_pool_size",
+			Help: "Number of started game servers waiting for a game",
+		},
+	)
+	WarmPoolClaims = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_warm_pool_claims_total",
+			Help: "Number of games offered to the warm pool, by result (hit, empty, failed)",
+		},
+		[]string{"result"},
+	)
+	ColdStarts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_cold_starts_total",
+			Help: "Number of games that started a new container on /create",
+		},
+	)
+	ReadyDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "game_orchestrator_ready_seconds",
+			Help:    "Time from starting a game server until it answers its health check",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15},
+		},
+	)
+	ReconcileDrift = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_reconcile_drift_total",
+			Help: "Number of differences between the registry and the running game servers fixed by reconciling, by kind (adopted, lost, orphaned)",
+		},
+		[]string{"kind"},
+	)
+	AllocationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "game_orchestrator_allocation_failures_total",
+			Help: "Number of /create requests that got no game server, by reason (create, start, not_ready)",
+		},
+		[]string{"reason"},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(OngoingMatches)
+	prometheus.MustRegister(OngoingMatches, ReportedLeavers, ReportedResults, BackfillRequests, WarmPoolSize, WarmPoolClaims, ColdStarts, ReadyDuration, AllocationFailures, ReconcileDrift)
 }
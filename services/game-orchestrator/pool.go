@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"game-orchestrator/metrics"
+	"game-orchestrator/provisioner"
+
+	"github.com/google/uuid"
+)
+
+// warmRefillInterval is how often the pool retries to fill up after failures.
+const warmRefillInterval = 10 * time.Second
+
+var errPoolEmpty = errors.New("warm pool is empty")
+
+// warmServer is a started game server without a game.
+type warmServer struct {
+	id       string
+	addr     string
+	claimed  bool   // taken from the pool for a game
+	assigned bool   // running the game it was claimed for
+	gameID   string // the game, once assigned
+	exited   bool
+}
+
+// warmPool keeps a number of started game servers ready, so that /create only
+// has to hand one its game instead of starting a container.
+type warmPool struct {
+	size   int
+	refill chan struct{}
+
+	mu       sync.Mutex
+	ready    []*warmServer // oldest first
+	starting int
+}
+
+func newWarmPool(size int) *warmPool {
+	return &warmPool{size: size, refill: make(chan struct{}, 1)}
+}
+
+// run keeps the pool filled, after every claim and on an interval.
+func (p *warmPool) run(ctx context.Context) {
+	log.Printf("Keeping %d warm game servers", p.size)
+	ticker := time.NewTicker(warmRefillInterval)
+	defer ticker.Stop()
+	for {
+		p.fill(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *warmPool) triggerRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fill starts servers until the pool is full. It stops at the first failure
+// and leaves the rest to the next round.
+func (p *warmPool) fill(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		if len(p.ready)+p.starting >= p.size {
+			p.mu.Unlock()
+			return
+		}
+		p.starting++
+		p.mu.Unlock()
+
+		s, err := startWarmServer(ctx)
+
+		p.mu.Lock()
+		p.starting--
+		if err == nil {
+			p.ready = append(p.ready, s)
+			metrics.WarmPoolSize.Set(float64(len(p.ready)))
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Error starting warm game server: %v", err)
+			return
+		}
+		go p.watch(s)
+	}
+}
+
+// watch waits for a warm server to exit. One that exits before it is claimed
+// leaves the pool; one that ran a game ends that game.
+func (p *warmPool) watch(s *warmServer) {
+	code := waitForExit(s.id)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.exited = true
+	if s.assigned {
+		go games.finish(s.gameID, code)
+		metrics.OngoingMatches.Dec()
+		return
+	}
+	if !s.claimed {
+		for i, r := range p.ready {
+			if r == s {
+				p.ready = append(p.ready[:i], p.ready[i+1:]...)
+				break
+			}
+		}
+		metrics.WarmPoolSize.Set(float64(len(p.ready)))
+		log.Printf("Warm game server %s exited before it was claimed", s.id)
+		p.triggerRefill()
+	}
+}
+
+// claim takes the oldest warm server out of the pool and hands it the game.
+// The server is renamed after the game, so that it is found like any
+// other game server. A server that does not take the game is removed.
+func (p *warmPool) claim(ctx context.Context, req CreateGameRequest) error {
+	p.mu.Lock()
+	if len(p.ready) == 0 {
+		p.mu.Unlock()
+		metrics.WarmPoolClaims.WithLabelValues("empty").Inc()
+		return errPoolEmpty
+	}
+	s := p.ready[0]
+	p.ready = p.ready[1:]
+	s.claimed = true
+	metrics.WarmPoolSize.Set(float64(len(p.ready)))
+	p.mu.Unlock()
+	p.triggerRefill()
+
+	if err := assignWarmServer(ctx, s, req); err != nil {
+		_ = backend.Stop(ctx, s.id)
+		metrics.WarmPoolClaims.WithLabelValues("failed").Inc()
+		return fmt.Errorf("assigning warm server %s: %w", s.id, err)
+	}
+
+	games.add(GameSession{
+		ID:          req.GameID,
+		ContainerID: s.id,
+		Address:     s.addr,
+		State:       StateReady,
+		Region:      req.Region,
+		Duration:    req.Duration,
+		Warm:        true,
+		StartedAt:   time.Now(),
+		Players:     req.Players,
+		Bots:        req.Bots,
+		watched:     true,
+	})
+	p.mu.Lock()
+	exited := s.exited
+	if !exited {
+		s.assigned = true
+		s.gameID = req.GameID
+		metrics.OngoingMatches.Inc()
+	}
+	p.mu.Unlock()
+	if exited {
+		games.finish(req.GameID, -1)
+	}
+
+	metrics.WarmPoolClaims.WithLabelValues("hit").Inc()
+	log.Printf("Assigned game %s to warm game server %s in region %s", req.GameID, s.id, req.Region)
+	return nil
+}
+
+// startWarmServer starts a game server that waits for a game, and returns it
+// once it answers its health check.
+func startWarmServer(ctx context.Context) (*warmServer, error) {
+	name := "game-warm-" + uuid.New().String()
+	id, err := backend.Create(ctx, provisioner.Spec{
+		Name:   name,
+		Env:    []string{"GAME_WARM=1"},
+		Labels: serverLabels(map[string]string{"pool": "warm"}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating game server: %w", err)
+	}
+	s := &warmServer{id: id}
+
+	err = backend.Start(ctx, id)
+	if err == nil {
+		var inst provisioner.Instance
+		inst, err = backend.Inspect(ctx, id)
+		s.addr = inst.Addr
+	}
+	if err == nil {
+		err = waitHealthy(ctx, s.addr, readyTimeout)
+	}
+	if err != nil {
+		_ = backend.Stop(ctx, id)
+		return nil, err
+	}
+
+	log.Printf("Started warm game server %s (%s)", name, id)
+	return s, nil
+}
+
+// assignWarmServer renames a claimed server after its game and hands it the
+// game's settings, roster and callbacks.
+func assignWarmServer(ctx context.Context, s *warmServer, req CreateGameRequest) error {
+	if err := backend.Rename(ctx, s.id, fmt.Sprintf("game-%s", req.GameID)); err != nil {
+		return fmt.Errorf("renaming game server: %w", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"game_id":      req.GameID,
+		"duration":     req.Duration,
+		"region":       req.Region,
+		"map":          req.Map,
+		"players":      req.Players,
+		"bots":         req.Bots,
+		"report_url":   callbackURL(req.GameID, "report"),
+		"result_url":   callbackURL(req.GameID, "result"),
+		"backfill_url": callbackURL(req.GameID, "backfill"),
+		"token":        callbackToken(req.GameID),
+	})
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(fmt.Sprintf("http://%s/assign", s.addr), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("game server returned status %d", resp.StatusCode)
+	}
+	return nil
+}
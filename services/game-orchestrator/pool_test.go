@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"game-orchestrator/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWarmPoolClaim(t *testing.T) {
+	srv := newTestServer(t, http.StatusOK)
+	fake := setupFake(t, srv)
+	ctx := context.Background()
+	ongoing := testutil.ToFloat64(metrics.OngoingMatches)
+
+	p := newWarmPool(1)
+	p.fill(ctx)
+	if len(p.ready) != 1 {
+		t.Fatalf("pool has %d servers, want 1", len(p.ready))
+	}
+	warmID := p.ready[0].id
+
+	req := CreateGameRequest{GameID: "g1", Duration: "30s", Region: "eu"}
+	if err := p.claim(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	g := waitForState(t, "g1", StateReady)
+	if !g.Warm || g.ContainerID != warmID {
+		t.Errorf("unexpected game %+v", g)
+	}
+	if inst, err := fake.Inspect(ctx, "game-g1"); err != nil || inst.ID != warmID {
+		t.Errorf("warm server was not renamed after its game: %+v, %v", inst, err)
+	}
+	srv.mu.Lock()
+	assignments := srv.assignments
+	srv.mu.Unlock()
+	if len(assignments) != 1 || assignments[0]["game_id"] != "g1" || assignments[0]["token"] != callbackToken("g1") {
+		t.Errorf("unexpected assignments %v", assignments)
+	}
+	if got := testutil.ToFloat64(metrics.OngoingMatches); got != ongoing+1 {
+		t.Errorf("%v ongoing matches, want %v", got, ongoing+1)
+	}
+
+	// The pool is only refilled by run
+	if err := p.claim(ctx, CreateGameRequest{GameID: "g2"}); !errors.Is(err, errPoolEmpty) {
+		t.Errorf("got %v, want %v", err, errPoolEmpty)
+	}
+
+	// The watcher of the warm server ends its game
+	if err := fake.Exit(warmID, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, "g1", StateEnded)
+}
+
+func TestWarmPoolUnclaimedExit(t *testing.T) {
+	srv := newTestServer(t, http.StatusOK)
+	fake := setupFake(t, srv)
+
+	p := newWarmPool(1)
+	p.fill(context.Background())
+	if len(p.ready) != 1 {
+		t.Fatalf("pool has %d servers, want 1", len(p.ready))
+	}
+	if err := fake.Exit(p.ready[0].id, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the server to leave the pool", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.ready) == 0
+	})
+	if err := p.claim(context.Background(), CreateGameRequest{GameID: "g1"}); !errors.Is(err, errPoolEmpty) {
+		t.Errorf("got %v, want %v", err, errPoolEmpty)
+	}
+}
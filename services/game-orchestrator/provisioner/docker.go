@@ -0,0 +1,174 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// gamePort is the port game servers listen on inside their container.
+const gamePort = "8080"
+
+// Docker runs game servers as containers of an image on one Docker network.
+type Docker struct {
+	client  *client.Client
+	image   string
+	network string
+}
+
+// NewDocker connects to the Docker daemon configured in the environment.
+func NewDocker(image, networkName string) (*Docker, error) {
+	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{client: c, image: image, network: networkName}, nil
+}
+
+func (d *Docker) Close() error {
+	return d.client.Close()
+}
+
+// Gateway returns the gateway of the game network, through which game
+// servers reach the host.
+func (d *Docker) Gateway(ctx context.Context) (string, error) {
+	nw, err := d.client.NetworkInspect(ctx, d.network, network.InspectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("inspecting network %s: %w", d.network, err)
+	}
+	for _, cfg := range nw.IPAM.Config {
+		if cfg.Gateway != "" {
+			return cfg.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no gateway", d.network)
+}
+
+func (d *Docker) Create(ctx context.Context, spec Spec) (string, error) {
+	config := &container.Config{
+		Image:  d.image,
+		Env:    spec.Env,
+		Labels: spec.Labels,
+		ExposedPorts: nat.PortSet{
+			gamePort + "/tcp": struct{}{},
+		},
+	}
+	hostConfig := &container.HostConfig{
+		AutoRemove: true, // Clean up container after it exits
+	}
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			d.network: {},
+		},
+	}
+
+	resp, err := d.client.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) Start(ctx context.Context, id string) error {
+	return d.client.ContainerStart(ctx, id, container.StartOptions{})
+}
+
+func (d *Docker) Inspect(ctx context.Context, id string) (Instance, error) {
+	info, err := d.client.ContainerInspect(ctx, id)
+	if cerrdefs.IsNotFound(err) {
+		return Instance{}, fmt.Errorf("%s: %w", id, ErrNotFound)
+	} else if err != nil {
+		return Instance{}, err
+	}
+
+	inst := Instance{
+		ID:   info.ID,
+		Name: strings.TrimPrefix(info.Name, "/"),
+	}
+	if info.Config != nil {
+		inst.Env = info.Config.Env
+		inst.Labels = info.Config.Labels
+	}
+	if info.State != nil {
+		inst.Running = info.State.Running
+	}
+	inst.Created, _ = time.Parse(time.RFC3339Nano, info.Created)
+
+	if info.NetworkSettings != nil {
+		ip := info.NetworkSettings.IPAddress
+		if ip == "" {
+			for _, net := range info.NetworkSettings.Networks {
+				ip = net.IPAddress
+				break
+			}
+		}
+		if ip != "" {
+			inst.Addr = ip + ":" + gamePort
+		}
+	}
+	return inst, nil
+}
+
+func (d *Docker) Wait(ctx context.Context, id string) (int, error) {
+	statusCh, errCh := d.client.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return -1, err
+	case status := <-statusCh:
+		return int(status.StatusCode), nil
+	}
+}
+
+func (d *Docker) Stop(ctx context.Context, id string) error {
+	err := d.client.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	if cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("%s: %w", id, ErrNotFound)
+	}
+	return err
+}
+
+func (d *Docker) List(ctx context.Context, labels map[string]string) ([]Instance, error) {
+	args := filters.NewArgs()
+	for k, v := range labels {
+		args.Add("label", k+"="+v)
+	}
+	containers, err := d.client.ContainerList(ctx, container.ListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Instance, 0, len(containers))
+	for _, c := range containers {
+		inst := Instance{
+			ID:      c.ID,
+			Labels:  c.Labels,
+			Running: c.State == container.StateRunning,
+			Created: time.Unix(c.Created, 0),
+		}
+		if len(c.Names) > 0 {
+			inst.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if c.NetworkSettings != nil {
+			for _, net := range c.NetworkSettings.Networks {
+				if net.IPAddress != "" {
+					inst.Addr = net.IPAddress + ":" + gamePort
+					break
+				}
+			}
+		}
+		list = append(list, inst)
+	}
+	return list, nil
+}
+
+func (d *Docker) Rename(ctx context.Context, id, name string) error {
+	return d.client.ContainerRename(ctx, id, name)
+}
@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fake keeps instances in memory without running anything. Started instances
+// run until they are stopped or end with Exit.
+type Fake struct {
+	// Addr is reported as the address of every started instance, e.g. of a
+	// test server standing in for the game servers.
+	Addr string
+
+	instances *table[fakeInstance]
+	mu        sync.Mutex
+	next      int
+}
+
+type fakeInstance struct {
+	inst     Instance
+	started  bool
+	done     chan struct{}
+	once     sync.Once
+	exitCode int // set before done is closed
+}
+
+func NewFake(addr string) *Fake {
+	return &Fake{Addr: addr, instances: newTable[fakeInstance]()}
+}
+
+func (f *Fake) Create(ctx context.Context, spec Spec) (string, error) {
+	f.mu.Lock()
+	f.next++
+	id := fmt.Sprintf("fake-%d", f.next)
+	f.mu.Unlock()
+
+	i := &fakeInstance{
+		inst: Instance{
+			ID:      id,
+			Env:     spec.Env,
+			Labels:  spec.Labels,
+			Created: time.Now(),
+		},
+		done: make(chan struct{}),
+	}
+	if err := f.instances.add(id, spec.Name, i); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (f *Fake) Start(ctx context.Context, id string) error {
+	i, err := f.instances.get(id)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i.started = true
+	return nil
+}
+
+func (f *Fake) Inspect(ctx context.Context, id string) (Instance, error) {
+	i, err := f.instances.get(id)
+	if err != nil {
+		return Instance{}, err
+	}
+	inst := i.inst
+	inst.Name = f.instances.nameOf(inst.ID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i.started {
+		inst.Addr = f.Addr
+		inst.Running = true
+	}
+	return inst, nil
+}
+
+func (f *Fake) Wait(ctx context.Context, id string) (int, error) {
+	i, err := f.instances.getRemoved(id)
+	if err != nil {
+		return -1, err
+	}
+	select {
+	case <-i.done:
+		return i.exitCode, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+// Stop ends the instance with exit code 137, like a killed container.
+func (f *Fake) Stop(ctx context.Context, id string) error {
+	return f.Exit(id, 137)
+}
+
+func (f *Fake) Rename(ctx context.Context, id, name string) error {
+	i, err := f.instances.get(id)
+	if err != nil {
+		return err
+	}
+	return f.instances.rename(i.inst.ID, name)
+}
+
+// Exit ends an instance as if its game server had exited with the given
+// code, and removes it.
+func (f *Fake) Exit(id string, code int) error {
+	i, err := f.instances.get(id)
+	if err != nil {
+		return err
+	}
+	f.instances.remove(i.inst.ID)
+	i.once.Do(func() {
+		i.exitCode = code
+		close(i.done)
+	})
+	return nil
+}
+
+func (f *Fake) List(ctx context.Context, labels map[string]string) ([]Instance, error) {
+	var list []Instance
+	for _, id := range f.instances.ids() {
+		inst, err := f.Inspect(ctx, id)
+		if err == nil && inst.Running && hasLabels(inst, labels) {
+			list = append(list, inst)
+		}
+	}
+	return list, nil
+}
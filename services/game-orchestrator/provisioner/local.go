@@ -0,0 +1,161 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Local runs game servers as processes of the game-server binary on this
+// machine, each on a free port of the loopback interface.
+type Local struct {
+	binary string
+	procs  *table[localProcess]
+}
+
+type localProcess struct {
+	inst     Instance
+	cmd      *exec.Cmd
+	started  atomic.Bool
+	done     chan struct{} // closed when the process has exited
+	exitCode int           // set before done is closed
+}
+
+// NewLocal runs the given game-server binary.
+func NewLocal(binary string) *Local {
+	return &Local{binary: binary, procs: newTable[localProcess]()}
+}
+
+func (l *Local) Create(ctx context.Context, spec Spec) (string, error) {
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+
+	id := uuid.New().String()
+	cmd := exec.Command(l.binary, "-port", strconv.Itoa(port))
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	p := &localProcess{
+		inst: Instance{
+			ID:      id,
+			Addr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+			Env:     spec.Env,
+			Labels:  spec.Labels,
+			Created: time.Now(),
+		},
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	if err := l.procs.add(id, spec.Name, p); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (l *Local) Start(ctx context.Context, id string) error {
+	p, err := l.procs.get(id)
+	if err != nil {
+		return err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return err
+	}
+	p.started.Store(true)
+
+	go func() {
+		p.cmd.Wait()
+		p.exitCode = p.cmd.ProcessState.ExitCode()
+		// Exited processes are removed like containers with AutoRemove
+		l.procs.remove(p.inst.ID)
+		close(p.done)
+	}()
+	return nil
+}
+
+func (l *Local) Inspect(ctx context.Context, id string) (Instance, error) {
+	p, err := l.procs.get(id)
+	if err != nil {
+		return Instance{}, err
+	}
+	inst := p.inst
+	inst.Name = l.procs.nameOf(inst.ID)
+	select {
+	case <-p.done:
+	default:
+		inst.Running = p.started.Load()
+	}
+	return inst, nil
+}
+
+func (l *Local) Wait(ctx context.Context, id string) (int, error) {
+	// The process may have exited and been removed already
+	p, err := l.procs.getRemoved(id)
+	if err != nil {
+		return -1, err
+	}
+	if !p.started.Load() {
+		return -1, fmt.Errorf("%s has not been started", id)
+	}
+	select {
+	case <-p.done:
+		return p.exitCode, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func (l *Local) Stop(ctx context.Context, id string) error {
+	p, err := l.procs.get(id)
+	if err != nil {
+		return err
+	}
+	if !p.started.Load() {
+		l.procs.remove(p.inst.ID)
+		return nil
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGKILL); err != nil {
+		return err
+	}
+	<-p.done
+	return nil
+}
+
+func (l *Local) Rename(ctx context.Context, id, name string) error {
+	p, err := l.procs.get(id)
+	if err != nil {
+		return err
+	}
+	return l.procs.rename(p.inst.ID, name)
+}
+
+func (l *Local) List(ctx context.Context, labels map[string]string) ([]Instance, error) {
+	var list []Instance
+	for _, id := range l.procs.ids() {
+		inst, err := l.Inspect(ctx, id)
+		if err == nil && inst.Running && hasLabels(inst, labels) {
+			list = append(list, inst)
+		}
+	}
+	return list, nil
+}
+
+// freePort returns a port on the loopback interface that nothing listens on.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,169 @@
+// Package provisioner runs game servers for the orchestrator. Game servers
+// run in Docker containers in production; they can also run as local
+// processes or, for tests, only in memory.
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for instances that do not exist (anymore).
+var ErrNotFound = errors.New("instance not found")
+
+// Spec describes a game server to create.
+type Spec struct {
+	// Name is unique among the instances, e.g. game-{id}.
+	Name   string
+	Env    []string // KEY=value
+	Labels map[string]string
+}
+
+// Instance is a created game server.
+type Instance struct {
+	ID      string
+	Name    string
+	Addr    string // host:port the game server listens on, once started
+	Env     []string
+	Labels  map[string]string
+	Running bool
+	Created time.Time
+}
+
+// Provisioner creates and runs game servers. Instances are removed once they
+// exit, like containers with AutoRemove.
+type Provisioner interface {
+	// Create prepares an instance and returns its ID.
+	Create(ctx context.Context, spec Spec) (string, error)
+	Start(ctx context.Context, id string) error
+	// Inspect looks an instance up by ID or name.
+	Inspect(ctx context.Context, id string) (Instance, error)
+	// Wait blocks until the instance exits and returns its exit code.
+	Wait(ctx context.Context, id string) (int, error)
+	// Stop kills and removes the instance.
+	Stop(ctx context.Context, id string) error
+	// Rename gives the instance a new unique name.
+	Rename(ctx context.Context, id, name string) error
+	// List returns the running instances that have all the given labels.
+	List(ctx context.Context, labels map[string]string) ([]Instance, error)
+}
+
+// hasLabels reports whether an instance has all the given labels.
+func hasLabels(inst Instance, labels map[string]string) bool {
+	for k, v := range labels {
+		if inst.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// table keeps the instances of the in-process provisioners by ID and name.
+// Removed instances are kept by ID, so that they can still be waited for.
+type table[T any] struct {
+	mu      sync.Mutex
+	byID    map[string]*T
+	byName  map[string]string
+	removed map[string]*T
+}
+
+func newTable[T any]() *table[T] {
+	return &table[T]{byID: make(map[string]*T), byName: make(map[string]string), removed: make(map[string]*T)}
+}
+
+func (t *table[T]) add(id, name string, v *T) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byName[name]; ok {
+		return fmt.Errorf("name %s is already in use", name)
+	}
+	t.byID[id] = v
+	t.byName[name] = id
+	return nil
+}
+
+// get returns the instance with the given ID or name.
+func (t *table[T]) get(idOrName string) (*T, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.byName[idOrName]; ok {
+		idOrName = id
+	}
+	v, ok := t.byID[idOrName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", idOrName, ErrNotFound)
+	}
+	return v, nil
+}
+
+// getRemoved is get, falling back to the removed instances by ID.
+func (t *table[T]) getRemoved(idOrName string) (*T, error) {
+	v, err := t.get(idOrName)
+	if err == nil {
+		return v, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.removed[idOrName]; ok {
+		return v, nil
+	}
+	return nil, err
+}
+
+func (t *table[T]) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.byID[id]; ok {
+		t.removed[id] = v
+	}
+	delete(t.byID, id)
+	for name, v := range t.byName {
+		if v == id {
+			delete(t.byName, name)
+		}
+	}
+}
+
+func (t *table[T]) rename(id, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[id]; !ok {
+		return fmt.Errorf("%s: %w", id, ErrNotFound)
+	}
+	if _, ok := t.byName[name]; ok {
+		return fmt.Errorf("name %s is already in use", name)
+	}
+	for old, v := range t.byName {
+		if v == id {
+			delete(t.byName, old)
+		}
+	}
+	t.byName[name] = id
+	return nil
+}
+
+// ids returns the IDs of all instances.
+func (t *table[T]) ids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, 0, len(t.byID))
+	for id := range t.byID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// nameOf returns the current name of an instance.
+func (t *table[T]) nameOf(id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, v := range t.byName {
+		if v == id {
+			return name
+		}
+	}
+	return ""
+}
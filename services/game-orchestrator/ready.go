@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"game-orchestrator/metrics"
+)
+
+// readyTimeout is how long a new game server may take to answer its health
+// check before it is torn down. READY_TIMEOUT overrides it.
+var readyTimeout = 15 * time.Second
+
+// Reasons an allocation fails.
+const (
+	failCreate   = "create"    // the game server could not be created
+	failStart    = "start"     // the game server could not be started
+	failNotReady = "not_ready" // the game server never answered its health check
+)
+
+// allocationError is a game server that could not be provided. It is answered
+// with its status code and counted by its reason.
+type allocationError struct {
+	reason string
+	status int
+	err    error
+}
+
+func (e *allocationError) Error() string { return e.err.Error() }
+func (e *allocationError) Unwrap() error { return e.err }
+
+// waitHealthy polls the game server's health check until it answers or the
+// timeout passes.
+func waitHealthy(ctx context.Context, addr string, timeout time.Duration) error {
+	if addr == "" {
+		return fmt.Errorf("game server has no address")
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: time.Second}
+	url := fmt.Sprintf("http://%s/health", addr)
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				metrics.ReadyDuration.Observe(time.Since(start).Seconds())
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("game server not healthy after %s", timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"game-orchestrator/metrics"
+	"game-orchestrator/provisioner"
+)
+
+// Labels on every game server the orchestrator starts, so that it finds them
+// again after a restart.
+const (
+	labelApp      = "app"      // always appGameServer
+	labelRun      = "run"      // the orchestrator process that started the server
+	labelGame     = "game"     // the game ID, on servers started for a game
+	labelDuration = "duration" // the game duration, on servers started for a game
+	appGameServer = "game-server"
+)
+
+// runID tells the servers of this orchestrator process from earlier ones.
+var runID string
+
+// reconcileInterval is how often the running servers are compared with the
+// registry. RECONCILE_INTERVAL overrides it.
+var reconcileInterval = 30 * time.Second
+
+// maxGameDuration is assumed for servers whose game duration is unknown.
+const maxGameDuration = time.Hour
+
+// orphanGrace is how long a server may outlive its game before it is killed.
+const orphanGrace = time.Minute
+
+// Kinds of drift between the registry and the running servers.
+const (
+	driftAdopted  = "adopted"  // a live game server we did not watch
+	driftLost     = "lost"     // a live game in the registry without a server
+	driftOrphaned = "orphaned" // a server that outlived its game, killed
+)
+
+// serverLabels returns the labels of a new game server.
+func serverLabels(extra map[string]string) map[string]string {
+	labels := map[string]string{labelApp: appGameServer, labelRun: runID}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
+
+// runReconciler reconciles on an interval.
+func runReconciler(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reconcile(ctx); err != nil {
+				log.Printf("Error reconciling game servers: %v", err)
+			}
+		}
+	}
+}
+
+// reconcile compares the running game servers with the registry. Servers of
+// this process are watched already. Those of an earlier process are adopted
+// and watched again, or killed if they outlived their game; warm servers of
+// an earlier process never got a game and are killed right away. Live games
+// that nobody watches and that have no server any more are marked crashed.
+func reconcile(ctx context.Context) error {
+	servers, err := backend.List(ctx, map[string]string{labelApp: appGameServer})
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]bool)
+	for _, inst := range servers {
+		if strings.HasPrefix(inst.Name, "game-warm-") {
+			if inst.Labels[labelRun] != runID {
+				killOrphan(ctx, inst, "")
+			}
+			continue
+		}
+		gameID := strings.TrimPrefix(inst.Name, "game-")
+		running[gameID] = true
+		if inst.Labels[labelRun] == runID {
+			continue
+		}
+
+		g, known := games.get(gameID)
+		if known && g.watched {
+			continue
+		}
+		if !known {
+			g = GameSession{
+				ID:        gameID,
+				Region:    inst.Labels["region"],
+				Duration:  inst.Labels[labelDuration],
+				StartedAt: inst.Created,
+			}
+		}
+		if time.Now().After(gameEnd(ctx, g, inst).Add(orphanGrace)) {
+			killOrphan(ctx, inst, gameID)
+			continue
+		}
+		adopt(g, inst)
+	}
+
+	for _, g := range games.list("") {
+		if g.finished() || g.watched || running[g.ID] {
+			continue
+		}
+		log.Printf("Game %s has no game server any more", g.ID)
+		games.finish(g.ID, -1)
+		metrics.ReconcileDrift.WithLabelValues(driftLost).Inc()
+	}
+	return nil
+}
+
+// adopt watches the server of a game started by an earlier process.
+func adopt(g GameSession, inst provisioner.Instance) {
+	g.ContainerID = inst.ID
+	g.Address = inst.Addr
+	g.State = StateRunning
+	g.watched = true
+	games.add(g)
+
+	metrics.OngoingMatches.Inc()
+	go func() {
+		code := waitForExit(inst.ID)
+		games.finish(g.ID, code)
+		metrics.OngoingMatches.Dec()
+	}()
+
+	log.Printf("Adopted game server %s (%s) of game %s", inst.Name, inst.ID, g.ID)
+	metrics.ReconcileDrift.WithLabelValues(driftAdopted).Inc()
+}
+
+// killOrphan stops a server of an earlier process that has no game to run.
+func killOrphan(ctx context.Context, inst provisioner.Instance, gameID string) {
+	if err := backend.Stop(ctx, inst.ID); err != nil && !errors.Is(err, provisioner.ErrNotFound) {
+		log.Printf("Error stopping orphaned game server %s: %v", inst.Name, err)
+		return
+	}
+	if gameID != "" {
+		games.finish(gameID, -1)
+	}
+	log.Printf("Stopped orphaned game server %s (%s)", inst.Name, inst.ID)
+	metrics.ReconcileDrift.WithLabelValues(driftOrphaned).Inc()
+}
+
+// gameEnd returns when the game on a server ends. The registry knows the
+// duration of the games it kept, and servers started for a game are labelled
+// with it. Servers claimed from the warm pool carry no game labels, so for
+// those the server is asked; if it does not answer, the game is assumed to
+// take the longest a game may take.
+func gameEnd(ctx context.Context, g GameSession, inst provisioner.Instance) time.Time {
+	if g.Duration == "" && inst.Addr != "" {
+		if endsAt, err := fetchGameEnd(ctx, inst.Addr); err == nil {
+			return endsAt
+		} else {
+			log.Printf("Error asking game server %s when its game ends: %v", inst.Name, err)
+		}
+	}
+	return g.StartedAt.Add(gameDuration(g.Duration))
+}
+
+// fetchGameEnd asks a game server when its game ends.
+func fetchGameEnd(ctx context.Context, addr string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/status", addr), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("game server returned status %d", resp.StatusCode)
+	}
+	var status struct {
+		EndsAt time.Time `json:"ends_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return time.Time{}, err
+	}
+	return status.EndsAt, nil
+}
+
+// gameDuration parses the duration of a game, falling back to the longest
+// a game may take.
+func gameDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return maxGameDuration
+	}
+	return d
+}
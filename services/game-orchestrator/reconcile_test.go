@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"game-orchestrator/provisioner"
+)
+
+// startFake starts an instance on the fake provisioner, as if an orchestrator
+// process had started it.
+func startFake(t *testing.T, fake *provisioner.Fake, name string, labels map[string]string) string {
+	t.Helper()
+	ctx := context.Background()
+	id, err := fake.Create(ctx, provisioner.Spec{Name: name, Labels: labels})
+	if err == nil {
+		err = fake.Start(ctx, id)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestReconcile(t *testing.T) {
+	srv := newTestServer(t, http.StatusOK)
+	srv.gameEnd = time.Now().Add(-2 * orphanGrace)
+	fake := setupFake(t, srv)
+	ctx := context.Background()
+	earlier := map[string]string{labelApp: appGameServer, labelRun: "earlier"}
+	withGame := func(gameID string) map[string]string {
+		labels := map[string]string{labelGame: gameID, labelDuration: "30s"}
+		for k, v := range earlier {
+			labels[k] = v
+		}
+		return labels
+	}
+
+	// A game of an earlier process that is still being played
+	adoptedID := startFake(t, fake, "game-adopted", withGame("adopted"))
+	// A game of an earlier process that should have ended long ago
+	games.add(GameSession{ID: "orphaned", State: StateRunning, Duration: "30s", StartedAt: time.Now().Add(-time.Hour)})
+	startFake(t, fake, "game-orphaned", withGame("orphaned"))
+	// A warm server of an earlier process
+	startFake(t, fake, "game-warm-earlier", earlier)
+	// A warm server an earlier process claimed, whose game ended long ago
+	startFake(t, fake, "game-claimed", map[string]string{labelApp: appGameServer, labelRun: "earlier", "pool": "warm"})
+	// A game of this process, watched already
+	ownID := startFake(t, fake, "game-own", serverLabels(map[string]string{labelGame: "own"}))
+	// A game whose server is gone
+	games.add(GameSession{ID: "lost", State: StateRunning, StartedAt: time.Now()})
+
+	if err := reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	g := waitForState(t, "adopted", StateRunning)
+	if !g.watched || g.ContainerID != adoptedID || g.Duration != "30s" {
+		t.Errorf("unexpected adopted game %+v", g)
+	}
+	waitForState(t, "orphaned", StateCrashed)
+	waitForState(t, "lost", StateCrashed)
+	for _, name := range []string{"game-orphaned", "game-warm-earlier", "game-claimed"} {
+		if _, err := fake.Inspect(ctx, name); !errors.Is(err, provisioner.ErrNotFound) {
+			t.Errorf("%s was not stopped: %v", name, err)
+		}
+	}
+	if inst, err := fake.Inspect(ctx, ownID); err != nil || !inst.Running {
+		t.Errorf("server of this process was touched: %+v, %v", inst, err)
+	}
+	if _, ok := games.get("own"); ok {
+		t.Errorf("server of this process was adopted")
+	}
+
+	// The adopted server is watched like our own
+	if err := fake.Exit(adoptedID, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, "adopted", StateEnded)
+}
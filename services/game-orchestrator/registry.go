@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"game-orchestrator/provisioner"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// GameState is where a game is in its lifecycle.
+type GameState string
+
+const (
+	StateStarting GameState = "starting" // the server was created and is starting up
+	StateReady    GameState = "ready"    // the server answers and waits for players
+	StateRunning  GameState = "running"  // players have connected
+	StateEnded    GameState = "ended"    // the server exited cleanly or was stopped
+	StateCrashed  GameState = "crashed"  // the server failed or exited with an error
+)
+
+// endedGameRetention is how long games are kept after they ended.
+const endedGameRetention = 10 * time.Minute
+
+// liveGameTTL bounds how long a persisted game outlives an orchestrator that
+// lost track of it.
+const liveGameTTL = 24 * time.Hour
+
+// GameSession is a game the orchestrator started.
+type GameSession struct {
+	ID          string       `json:"game_id"`
+	ContainerID string       `json:"container_id"`
+	Address     string       `json:"address,omitempty"`
+	State       GameState    `json:"state"`
+	Region      string       `json:"region"`
+	Duration    string       `json:"duration,omitempty"`
+	Warm        bool         `json:"warm,omitempty"` // taken from the warm pool
+	StartedAt   time.Time    `json:"started_at"`
+	EndedAt     *time.Time   `json:"ended_at,omitempty"`
+	ExitCode    *int         `json:"exit_code,omitempty"`
+	Players     []GamePlayer `json:"players,omitempty"`
+	Bots        []GameBot    `json:"bots,omitempty"`
+
+	// stopping is set when the game is stopped on request, so that it ends
+	// instead of crashing when it is killed
+	stopping bool
+	// watched is set while a goroutine of this process waits for the server
+	// to exit. Games loaded from Redis are not watched until reconciled.
+	watched bool
+	// version orders the snapshots of the game written to Redis
+	version uint64
+}
+
+func (g *GameSession) finished() bool {
+	return g.State == StateEnded || g.State == StateCrashed
+}
+
+// gameRegistry keeps every game by ID. With Redis configured, it also writes
+// each change through to orchestrator:game:{id}.
+type gameRegistry struct {
+	mu      sync.Mutex
+	games   map[string]*GameSession
+	version uint64 // of the last change
+	rdb     *redis.Client
+
+	// persistMu serializes the writes to Redis; written holds the version
+	// last written per game, so that an older snapshot never overwrites a
+	// newer one
+	persistMu sync.Mutex
+	written   map[string]uint64
+}
+
+var games = newGameRegistry(nil)
+
+func newGameRegistry(rdb *redis.Client) *gameRegistry {
+	return &gameRegistry{games: make(map[string]*GameSession), rdb: rdb, written: make(map[string]uint64)}
+}
+
+func gameKey(gameID string) string {
+	return "orchestrator:game:" + gameID
+}
+
+// add records a new game, replacing any earlier one with the same ID.
+func (r *gameRegistry) add(g GameSession) {
+	r.mu.Lock()
+	r.version++
+	g.version = r.version
+	r.games[g.ID] = &g
+	r.mu.Unlock()
+	r.persist(g)
+}
+
+// update changes a game. It returns false if the game is unknown.
+func (r *gameRegistry) update(gameID string, change func(g *GameSession)) bool {
+	r.mu.Lock()
+	g, ok := r.games[gameID]
+	if !ok {
+		r.mu.Unlock()
+		return false
+	}
+	change(g)
+	r.version++
+	g.version = r.version
+	snapshot := *g
+	r.mu.Unlock()
+	r.persist(snapshot)
+	return true
+}
+
+// finish records that the game's server exited with the given code.
+func (r *gameRegistry) finish(gameID string, exitCode int) {
+	r.update(gameID, func(g *GameSession) {
+		if g.finished() {
+			return
+		}
+		now := time.Now()
+		g.EndedAt = &now
+		g.ExitCode = &exitCode
+		if exitCode == 0 || g.stopping {
+			g.State = StateEnded
+		} else {
+			g.State = StateCrashed
+		}
+	})
+}
+
+func (r *gameRegistry) get(gameID string) (GameSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.games[gameID]
+	if !ok {
+		return GameSession{}, false
+	}
+	return *g, true
+}
+
+// list returns the games in the given state, or all of them, oldest first.
+func (r *gameRegistry) list(state GameState) []GameSession {
+	r.mu.Lock()
+	list := make([]GameSession, 0, len(r.games))
+	for _, g := range r.games {
+		if state == "" || g.State == state {
+			list = append(list, *g)
+		}
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b GameSession) int { return a.StartedAt.Compare(b.StartedAt) })
+	return list
+}
+
+// prune forgets games that ended a while ago.
+func (r *gameRegistry) prune() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	for id, g := range r.games {
+		if g.EndedAt != nil && time.Since(*g.EndedAt) > endedGameRetention {
+			delete(r.games, id)
+			delete(r.written, id)
+		}
+	}
+}
+
+// persist writes a game through to Redis, unless a newer snapshot of it was
+// written already. Ended games expire with their retention. Failures are only
+// logged: the registry in memory is the truth.
+func (r *gameRegistry) persist(g GameSession) {
+	if r.rdb == nil {
+		return
+	}
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	if g.version <= r.written[g.ID] {
+		return
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		return
+	}
+	ttl := liveGameTTL
+	if g.finished() {
+		ttl = endedGameRetention
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := r.rdb.Set(ctx, gameKey(g.ID), data, ttl).Err(); err != nil {
+		log.Printf("Error persisting game %s: %v", g.ID, err)
+		return
+	}
+	r.written[g.ID] = g.version
+}
+
+// load restores the games persisted by earlier processes.
+func (r *gameRegistry) load(ctx context.Context) error {
+	if r.rdb == nil {
+		return nil
+	}
+
+	iter := r.rdb.Scan(ctx, 0, gameKey("*"), 100).Iterator()
+	loaded := 0
+	for iter.Next(ctx) {
+		data, err := r.rdb.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		var g GameSession
+		if err := json.Unmarshal(data, &g); err != nil {
+			log.Printf("Skipping corrupt game %s: %v", iter.Val(), err)
+			continue
+		}
+
+		r.mu.Lock()
+		if _, ok := r.games[g.ID]; !ok {
+			r.games[g.ID] = &g
+			loaded++
+		}
+		r.mu.Unlock()
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	log.Printf("Loaded %d games from Redis", loaded)
+	return nil
+}
+
+// runPruner prunes the registry once a minute.
+func (r *gameRegistry) runPruner(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.prune()
+		}
+	}
+}
+
+// handleGames lists the games: GET /games, optionally ?state=...
+func handleGames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(games.list(GameState(r.URL.Query().Get("state"))))
+}
+
+// handleGame shows a game on GET /games/{id} and force stops it on DELETE.
+func handleGame(w http.ResponseWriter, r *http.Request) {
+	gameID := strings.TrimPrefix(r.URL.Path, "/games/")
+	if gameID == "" || strings.Contains(gameID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		g, ok := games.get(gameID)
+		if !ok {
+			http.Error(w, "Game not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g)
+
+	case http.MethodDelete:
+		g, ok := games.get(gameID)
+		if !ok {
+			http.Error(w, "Game not found", http.StatusNotFound)
+			return
+		}
+		if g.finished() {
+			http.Error(w, "Game already "+string(g.State), http.StatusConflict)
+			return
+		}
+
+		games.update(gameID, func(g *GameSession) { g.stopping = true })
+		err := backend.Stop(r.Context(), g.ContainerID)
+		if errors.Is(err, provisioner.ErrNotFound) {
+			// Gone already, without us noticing
+			games.finish(gameID, -1)
+		} else if err != nil {
+			log.Printf("Error stopping game %s: %v", gameID, err)
+			http.Error(w, "Failed to stop game server", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Stopped game %s on request", gameID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -1,15 +1,76 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// gameEnd is when the game is over; players leaving earlier are reported to
+// reportURL, and replacements for them are requested from backfillURL. Every
+// callback carries gameToken, which the orchestrator checks.
+var (
+	gameID      string
+	gameEnd     time.Time
+	reportURL   = os.Getenv("REPORT_URL")
+	resultURL   = os.Getenv("RESULT_URL")
+	backfillURL = os.Getenv("BACKFILL_URL")
+	gameToken   = os.Getenv("GAME_TOKEN")
+)
+
+// started is closed once the server has a game. Warm servers are started
+// ahead of time and wait for the orchestrator to assign them one; the game
+// variables above are only read after it is closed.
+var started = make(chan struct{})
+
+// Assignment is the game the orchestrator hands to a warm server.
+type Assignment struct {
+	GameID      string          `json:"game_id"`
+	Duration    string          `json:"duration"`
+	Region      string          `json:"region"`
+	Map         string          `json:"map,omitempty"`
+	Bots        json.RawMessage `json:"bots,omitempty"`
+	Players     json.RawMessage `json:"players,omitempty"`
+	ReportURL   string          `json:"report_url"`
+	ResultURL   string          `json:"result_url"`
+	BackfillURL string          `json:"backfill_url"`
+	Token       string          `json:"token"`
+}
+
+// backfillCutoff is how long before the end of the game leavers are no longer
+// replaced.
+const backfillCutoff = 10 * time.Second
+
+// defaultSkill is the skill of players that connect without one.
+const defaultSkill = 1500.0
+
+// performanceSpread is how far a player's performance in a single game varies
+// around their skill.
+const performanceSpread = 200.0
+
+// players holds the skill of every player still in the game. Players who
+// leave early are removed and score nothing. leavers counts them per team;
+// matchmaking subtracts the replacements it already placed.
+var (
+	playersMu sync.Mutex
+	players   = make(map[string]float64)
+	leavers   = make(map[int]int)
+)
+
+// roster is the team of every player matchmaking put in the game, for
+// players that connect without one.
+var roster = make(map[string]int)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -20,25 +81,68 @@ var upgrader = websocket.Upgrader{
 
 func main() {
 	port := flag.String("port", "8080", "Port to listen on")
-	gameID := flag.String("game_id", os.Getenv("GAME_ID"), "Unique Game ID")
-	durationStr := flag.String("duration", os.Getenv("GAME_DURATION"), "Game duration (e.g. 30s)")
+	id := flag.String("game_id", os.Getenv("GAME_ID"), "Unique Game ID")
+	duration := flag.String("duration", os.Getenv("GAME_DURATION"), "Game duration (e.g. 30s)")
+	region := flag.String("region", os.Getenv("GAME_REGION"), "Region the server was placed in")
+	gameMap := flag.String("map", os.Getenv("GAME_MAP"), "Map the game is played on")
+	bots := flag.String("bots", os.Getenv("GAME_BOTS"), "Bots to simulate as a JSON list of id, team and skill")
+	playerList := flag.String("players", os.Getenv("GAME_PLAYERS"), "Players of the game as a JSON list of id and team")
+	warm := flag.Bool("warm", os.Getenv("GAME_WARM") != "", "Wait for the orchestrator to assign a game on /assign")
 	flag.Parse()
 
-	if *gameID == "" {
-		*gameID = "unknown"
-	}
+	http.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+		default:
+			http.Error(w, "No game assigned", http.StatusServiceUnavailable)
+			return
+		}
+		handleConnection(w, r, gameID)
+	})
 
-	duration := 30 * time.Second
-	if *durationStr != "" {
-		if d, err := time.ParseDuration(*durationStr); err == nil {
-			duration = d
-		} else {
-			log.Printf("Invalid duration format %s, defaulting to 30s", *durationStr)
+	var assignOnce sync.Once
+	http.HandleFunc("/assign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !*warm {
+			http.Error(w, "Server was started with a game", http.StatusConflict)
+			return
+		}
+		var a Assignment
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.GameID == "" {
+			http.Error(w, "game_id required", http.StatusBadRequest)
+			return
 		}
-	}
 
-	http.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
-		handleConnection(w, r, *gameID)
+		assigned := false
+		assignOnce.Do(func() {
+			reportURL, resultURL, backfillURL = a.ReportURL, a.ResultURL, a.BackfillURL
+			gameToken = a.Token
+			startGame(a.GameID, a.Duration, a.Region, a.Map, string(a.Bots), string(a.Players))
+			assigned = true
+		})
+		if !assigned {
+			http.Error(w, "Game already assigned", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// The orchestrator asks servers it lost track of when their game ends
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+		default:
+			http.Error(w, "No game assigned", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"game_id": gameID,
+			"ends_at": gameEnd,
+		})
 	})
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -50,18 +154,60 @@ func main() {
 		Addr: ":" + *port,
 	}
 
+	if *warm {
+		log.Printf("Warm game server listening on :%s, waiting for a game", *port)
+	} else {
+		startGame(*id, *duration, *region, *gameMap, *bots, *playerList)
+		log.Printf("Game Server %s listening on :%s", gameID, *port)
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// startGame sets up the game and starts its clock. The server exits when the
+// game ends.
+func startGame(id, durationStr, region, gameMap, bots, playerList string) {
+	gameID = id
+	if gameID == "" {
+		gameID = "unknown"
+	}
+
+	duration := 30 * time.Second
+	if durationStr != "" {
+		if d, err := time.ParseDuration(durationStr); err == nil {
+			duration = d
+		} else {
+			log.Printf("Invalid duration format %s, defaulting to 30s", durationStr)
+		}
+	}
+
+	if bots != "" && bots != "null" {
+		if err := addBots(bots); err != nil {
+			log.Printf("Invalid bots %s: %v", bots, err)
+		}
+	}
+	if playerList != "" && playerList != "null" {
+		if err := loadRoster(playerList); err != nil {
+			log.Printf("Invalid players %s: %v", playerList, err)
+		}
+	}
+
+	if gameMap == "" {
+		gameMap = "default"
+	}
+
+	gameEnd = time.Now().Add(duration)
+	close(started)
+
 	// Game shutdown timer
 	go func() {
-		log.Printf("Game %s started, will end in %v", *gameID, duration)
+		log.Printf("Game %s started on map %s in region %s, will end in %v", gameID, gameMap, region, duration)
 		time.Sleep(duration)
-		log.Printf("Game %s time expired, shutting down", *gameID)
+		log.Printf("Game %s time expired, shutting down", gameID)
+		reportResult(gameID)
 		os.Exit(0)
 	}()
-
-	log.Printf("Game Server %s listening on :%s", *gameID, *port)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal(err)
-	}
 }
 
 func handleConnection(w http.ResponseWriter, r *http.Request, gameID string) {
@@ -72,13 +218,44 @@ func handleConnection(w http.ResponseWriter, r *http.Request, gameID string) {
 	}
 	defer conn.Close()
 
-	log.Printf("Player connected to game %s", gameID)
+	playerID := r.URL.Query().Get("playerId")
+	log.Printf("Player %s connected to game %s", playerID, gameID)
+
+	// The simulated clients pass their hidden skill, which decides how well they play
+	skill := defaultSkill
+	if s, err := strconv.ParseFloat(r.URL.Query().Get("skill"), 64); err == nil {
+		skill = s
+	}
+	// Players without a team cannot be replaced
+	team := -1
+	if t, err := strconv.Atoi(r.URL.Query().Get("team")); err == nil {
+		team = t
+	} else if t, ok := roster[playerID]; ok {
+		team = t
+	}
+	if playerID != "" {
+		playersMu.Lock()
+		players[playerID] = skill
+		playersMu.Unlock()
+	}
 
 	// Simple game loop: Echo messages until disconnect or server shutdown
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("Read error (player disconnect): %v", err)
+			// The server exits when the game ends, so any disconnect before that is a leaver
+			if playerID != "" && time.Until(gameEnd) > time.Second {
+				playersMu.Lock()
+				delete(players, playerID)
+				leavers[team]++
+				open := leavers[team]
+				playersMu.Unlock()
+				reportLeaver(gameID, playerID)
+				if team >= 0 && time.Until(gameEnd) > backfillCutoff {
+					requestBackfill(gameID, team, open)
+				}
+			}
 			return
 		}
 
@@ -89,3 +266,135 @@ func handleConnection(w http.ResponseWriter, r *http.Request, gameID string) {
 		}
 	}
 }
+
+// addBots adds the bots matchmaking filled empty slots with. They play for
+// the whole game and score from their skill like everyone else.
+func addBots(spec string) error {
+	var bots []struct {
+		ID    string  `json:"id"`
+		Skill float64 `json:"skill"`
+	}
+	if err := json.Unmarshal([]byte(spec), &bots); err != nil {
+		return err
+	}
+
+	playersMu.Lock()
+	defer playersMu.Unlock()
+	for _, b := range bots {
+		players[b.ID] = b.Skill
+	}
+	log.Printf("Simulating %d bots", len(bots))
+	return nil
+}
+
+// loadRoster records the team of every player matchmaking put in the game.
+func loadRoster(spec string) error {
+	var list []struct {
+		ID   string `json:"id"`
+		Team int    `json:"team"`
+	}
+	if err := json.Unmarshal([]byte(spec), &list); err != nil {
+		return err
+	}
+	for _, p := range list {
+		roster[p.ID] = p.Team
+	}
+	return nil
+}
+
+// postCallback posts a JSON body to one of the orchestrator's callbacks.
+func postCallback(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Game-Token", gameToken)
+	client := &http.Client{Timeout: 5 * time.Second}
+	return client.Do(req)
+}
+
+// reportLeaver tells the orchestrator that a player left before the game ended.
+func reportLeaver(gameID, playerID string) {
+	if reportURL == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"gameId":   gameID,
+		"playerId": playerID,
+	})
+	resp, err := postCallback(reportURL, body)
+	if err != nil {
+		log.Printf("Reporting leaver %s failed: %v", playerID, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Reporting leaver %s failed with status %d", playerID, resp.StatusCode)
+		return
+	}
+	log.Printf("Reported player %s leaving game %s early", playerID, gameID)
+}
+
+// requestBackfill asks for replacements for the players who left a team. The
+// request replaces any earlier one for the team.
+func requestBackfill(gameID string, team, slots int) {
+	if backfillURL == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]int{
+		"team":  team,
+		"slots": slots,
+	})
+	resp, err := postCallback(backfillURL, body)
+	if err != nil {
+		log.Printf("Requesting backfill for team %d failed: %v", team, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Requesting backfill for team %d failed with status %d", team, resp.StatusCode)
+		return
+	}
+	log.Printf("Requested backfill of up to %d players for team %d of game %s", slots, team, gameID)
+}
+
+// reportResult sends the final score of every player still in the game to the
+// orchestrator. Each player's performance is drawn around their skill.
+func reportResult(gameID string) {
+	if resultURL == "" {
+		return
+	}
+
+	playersMu.Lock()
+	scores := make(map[string]float64, len(players))
+	for id, skill := range players {
+		performance := skill + rand.NormFloat64()*performanceSpread
+		scores[id] = math.Round(math.Max(performance, 0) / 10)
+	}
+	playersMu.Unlock()
+	if len(scores) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"gameId": gameID,
+		"scores": scores,
+	})
+	resp, err := postCallback(resultURL, body)
+	if err != nil {
+		log.Printf("Reporting result of game %s failed: %v", gameID, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Reporting result of game %s failed with status %d", gameID, resp.StatusCode)
+		return
+	}
+	log.Printf("Reported result of game %s for %d players", gameID, len(scores))
+}
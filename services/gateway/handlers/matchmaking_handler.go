@@ -7,6 +7,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"time"
 )
 
 func MatchmakingHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,5 +38,13 @@ func MatchmakingHandler(w http.ResponseWriter, r *http.Request) {
 		req.Host = targetURL.Host
 	}
 
+	// Status streams stay open until the ticket is matched, far longer than the
+	// server's timeouts. The proxy flushes event streams on its own.
+	if r.URL.Path == "/matchmaking/stream" {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+
 	proxy.ServeHTTP(w, r)
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// backfillCutoff is how long before the end of a game its seats stop being
+// filled; a replacement would barely get to play.
+const backfillCutoff = 10 * time.Second
+
+// BackfillRequest asks for replacements for players who left a running game,
+// filed by its game server through the orchestrator.
+type BackfillRequest struct {
+	GameID string `json:"gameId"`
+	Team   int    `json:"team"`
+	Slots  int    `json:"slots"`
+}
+
+// Backfill is an open request to fill seats on one team of a running match.
+// A new request for the same team replaces it.
+type Backfill struct {
+	ID      string     `json:"id"`
+	MatchID string     `json:"matchId"`
+	Queue   string     `json:"queue"`
+	Team    int        `json:"team"`
+	Slots   int        `json:"slots"`           // seats still open
+	Roles   []string   `json:"roles,omitempty"` // roles of the open seats in role queues
+	Rating  float64    `json:"rating"`          // average rating of the match
+	Region  string     `json:"region,omitempty"`
+	Server  ServerInfo `json:"server"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func backfillKey(id string) string {
+	return "backfill:" + id
+}
+
+// backfillsKey lists the open backfills of a queue, oldest first.
+func backfillsKey(q *QueueConfig) string {
+	return "backfills:" + q.Name
+}
+
+// matchLeftKey holds the players who left a running match early.
+func matchLeftKey(matchID string) string {
+	return "match:" + matchID + ":left"
+}
+
+// handleBackfill opens a backfill for a team of a running game. The requested
+// slots are capped at the seats the team actually has open, counting players
+// who were reported as leavers and replacements that already joined.
+func handleBackfill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.GameID == "" || req.Slots < 1 {
+		http.Error(w, "gameId and at least one slot are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	match, err := loadGameMatch(ctx, req.GameID)
+	if err == redis.Nil {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errCorruptMatch) {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if match.Lobby != "" {
+		http.Error(w, "private matches are not backfilled", http.StatusConflict)
+		return
+	}
+	q, ok := config.Queue(match.Queue)
+	if !ok {
+		http.Error(w, "unknown queue", http.StatusBadRequest)
+		return
+	}
+	if req.Team < 0 || req.Team >= len(match.Teams) {
+		http.Error(w, "unknown team", http.StatusBadRequest)
+		return
+	}
+
+	expires := match.CreatedAt.Add(time.Duration(q.GameDuration) - backfillCutoff)
+	if !time.Now().Before(expires) {
+		http.Error(w, "game is about to end", http.StatusConflict)
+		return
+	}
+
+	left, err := rdb.SMembers(ctx, matchLeftKey(match.MatchID)).Result()
+	if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	team := match.Teams[req.Team]
+	var active []string
+	for _, id := range team.Players {
+		if !slices.Contains(left, id) {
+			active = append(active, id)
+		}
+	}
+	slots := min(req.Slots, q.TeamSize-len(active))
+	if slots <= 0 {
+		http.Error(w, "team is full", http.StatusConflict)
+		return
+	}
+
+	backfill := Backfill{
+		ID:        match.MatchID + ":" + strconv.Itoa(req.Team),
+		MatchID:   match.MatchID,
+		Queue:     q.Name,
+		Team:      req.Team,
+		Slots:     slots,
+		Region:    match.Region,
+		Server:    match.Server,
+		CreatedAt: time.Now(),
+		ExpiresAt: expires,
+	}
+	for _, t := range match.Teams {
+		backfill.Rating += t.Rating / float64(len(match.Teams))
+	}
+	if q.Roles != nil {
+		// The seats keep the roles of the players who left
+		backfill.Roles = q.Roles.slots(1)
+		for _, id := range active {
+			if i := slices.Index(backfill.Roles, team.Roles[id]); i >= 0 {
+				backfill.Roles = slices.Delete(backfill.Roles, i, i+1)
+			}
+		}
+	}
+
+	if err := saveBackfill(ctx, backfill); err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	pipe := rdb.Pipeline()
+	pipe.LRem(ctx, backfillsKey(q), 0, backfill.ID)
+	pipe.RPush(ctx, backfillsKey(q), backfill.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	backfillRequests.WithLabelValues(q.Name).Inc()
+	log.Printf("[%s] Backfill of %d seats opened for team %d of match %s", q.Name, slots, req.Team, match.MatchID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backfill)
+}
+
+func saveBackfill(ctx context.Context, b Backfill) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, backfillKey(b.ID), data, time.Until(b.ExpiresAt)).Err()
+}
+
+// fillBackfills fills the open backfills of a queue from the searching
+// tickets, ahead of new matches. It returns the tickets that are left over.
+func fillBackfills(ctx context.Context, q *QueueConfig, tickets []queuedTicket) ([]queuedTicket, error) {
+	ids, err := rdb.LRange(ctx, backfillsKey(q), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return tickets, err
+	}
+
+	for _, id := range ids {
+		val, err := rdb.Get(ctx, backfillKey(id)).Result()
+		if err == redis.Nil {
+			// Expired with its game
+			rdb.LRem(ctx, backfillsKey(q), 0, id)
+			continue
+		} else if err != nil {
+			return tickets, err
+		}
+		var b Backfill
+		if err := json.Unmarshal([]byte(val), &b); err != nil {
+			rdb.LRem(ctx, backfillsKey(q), 0, id)
+			continue
+		}
+
+		picked := pickBackfill(b, q, tickets, time.Now())
+		if len(picked) == 0 {
+			continue
+		}
+		if err := fillBackfill(ctx, q, b, picked); err != nil {
+			return tickets, err
+		}
+		// Picked tickets are matched now or were taken by someone else
+		tickets = slices.DeleteFunc(tickets, func(t queuedTicket) bool {
+			return slices.ContainsFunc(picked, func(p queuedTicket) bool { return p.ID == t.ID })
+		})
+	}
+	return tickets, nil
+}
+
+// pickBackfill picks tickets for the open seats of a backfill in queue order.
+// A ticket must fit into the seats, be within its search window of the
+// match's average rating, reach the match's region within its ping window and,
+// in role queues, take the roles of the open seats.
+func pickBackfill(b Backfill, q *QueueConfig, tickets []queuedTicket, now time.Time) []queuedTicket {
+	var picked []queuedTicket
+	seats := b.Slots
+	for _, t := range tickets {
+		if seats == 0 {
+			break
+		}
+		if t.Size() > seats {
+			continue
+		}
+		if q.SearchWindow != nil && math.Abs(t.Rating-b.Rating) > q.SearchWindow.At(now.Sub(t.queuedSince()))/2 {
+			continue
+		}
+		if q.PingWindow != nil && b.Region != "" && !acceptablePing(t, b.Region, *q.PingWindow, now) {
+			continue
+		}
+		if b.Roles != nil && assignRoles(append(slices.Clip(picked), t), b.Roles) == nil {
+			continue
+		}
+		picked = append(picked, t)
+		seats -= t.Size()
+	}
+	return picked
+}
+
+// fillBackfill claims the picked tickets and places their players on the
+// backfill's team. The game is already running, so there is no ready check:
+// the tickets are matched right away with the existing server.
+func fillBackfill(ctx context.Context, q *QueueConfig, b Backfill, picked []queuedTicket) error {
+	claimed, err := claimTickets(ctx, q, picked)
+	if err != nil || len(claimed) == 0 {
+		return err
+	}
+
+	val, err := rdb.Get(ctx, "match:"+b.MatchID).Result()
+	if err == redis.Nil {
+		// The match is gone, so is the game
+		rdb.Del(ctx, backfillKey(b.ID))
+		rdb.LRem(ctx, backfillsKey(q), 0, b.ID)
+		return releaseTickets(ctx, q, StatusMatching, claimed, nil)
+	} else if err != nil {
+		return errors.Join(err, releaseTickets(ctx, q, StatusMatching, claimed, nil))
+	}
+	var match Match
+	if err := json.Unmarshal([]byte(val), &match); err != nil {
+		return errors.Join(fmt.Errorf("%w %s: %v", errCorruptMatch, b.MatchID, err), releaseTickets(ctx, q, StatusMatching, claimed, nil))
+	}
+
+	var assigned map[string]string
+	if b.Roles != nil {
+		assigned = assignRoles(claimed, b.Roles)
+	}
+	team := &match.Teams[b.Team]
+	ticketIDs := make([]string, 0, len(claimed))
+	patches := make([]map[string]interface{}, 0, len(claimed))
+	for _, t := range claimed {
+		ticketIDs = append(ticketIDs, t.ID)
+		patches = append(patches, map[string]interface{}{
+			"matchId":  b.MatchID,
+			"team":     b.Team,
+			"server":   b.Server,
+			"backfill": true,
+		})
+		for _, p := range t.Players {
+			match.Players = append(match.Players, p.PlayerID)
+			team.Players = append(team.Players, p.PlayerID)
+			if role, ok := assigned[p.PlayerID]; ok {
+				team.Roles[p.PlayerID] = role
+				if i := slices.Index(b.Roles, role); i >= 0 {
+					b.Roles = slices.Delete(b.Roles, i, i+1)
+				}
+			}
+		}
+	}
+
+	// Results and leaver reports of the game now include the new players
+	matchJSON, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+	if err := rdb.SetArgs(ctx, "match:"+b.MatchID, matchJSON, redis.SetArgs{KeepTTL: true}).Err(); err != nil {
+		return errors.Join(fmt.Errorf("saving match: %w", err), releaseTickets(ctx, q, StatusMatching, claimed, nil))
+	}
+	if err := transitionTickets(ctx, ticketIDs, StatusMatching, StatusMatched, patches); err != nil {
+		// Matched tickets cannot be taken back, so the match is saved first and
+		// restored here, before the tickets go back to the queue
+		err = fmt.Errorf("committing backfill tickets: %w", err)
+		if rerr := rdb.SetArgs(ctx, "match:"+b.MatchID, val, redis.SetArgs{KeepTTL: true}).Err(); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("restoring match: %w", rerr))
+		}
+		return errors.Join(err, releaseTickets(ctx, q, StatusMatching, claimed, nil))
+	}
+
+	filled := slotsUsed(claimed)
+	b.Slots -= filled
+	if b.Slots > 0 {
+		err = saveBackfill(ctx, b)
+	} else {
+		pipe := rdb.Pipeline()
+		pipe.Del(ctx, backfillKey(b.ID))
+		pipe.LRem(ctx, backfillsKey(q), 0, b.ID)
+		_, err = pipe.Exec(ctx)
+	}
+	if err != nil {
+		log.Printf("[%s] Updating backfill %s failed: %v", q.Name, b.ID, err)
+	}
+
+	backfilledPlayers.WithLabelValues(q.Name).Add(float64(filled))
+	backfillFillTime.WithLabelValues(q.Name).Observe(time.Since(b.CreatedAt).Seconds())
+	ticketsMatched.WithLabelValues(q.Name).Add(float64(len(claimed)))
+	for _, t := range claimed {
+		queueTime.WithLabelValues(q.Name).Observe(time.Since(t.CreatedAt).Seconds())
+	}
+	if err := recordWaits(ctx, q, claimed); err != nil {
+		log.Printf("[%s] Recording queue times failed: %v", q.Name, err)
+	}
+	if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+		queueSize.WithLabelValues(q.Name).Set(float64(size))
+	}
+
+	log.Printf("[%s] Backfilled %d players into team %d of match %s, %d seats still open", q.Name, filled, b.Team, b.MatchID, b.Slots)
+	return nil
+}
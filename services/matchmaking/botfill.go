@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// botPrefix starts the ID of every bot; players cannot queue with such IDs.
+const botPrefix = "bot-"
+
+// BotFillConfig lets a queue that cannot fill a match in time start it with
+// bots in the empty slots.
+type BotFillConfig struct {
+	// After is how long the oldest ticket waits before bots are added.
+	After Duration `json:"after"`
+	// MinPlayers is how many players a match needs besides bots (default 1).
+	MinPlayers int `json:"minPlayers,omitempty"`
+	// Rating of the bots; 0 uses the average rating of the players.
+	Rating float64 `json:"rating,omitempty"`
+}
+
+func (c *BotFillConfig) validate(matchSize int) error {
+	if c.After <= 0 {
+		return fmt.Errorf("bot fill needs a positive wait")
+	}
+	if c.MinPlayers <= 0 {
+		c.MinPlayers = 1
+	}
+	if c.MinPlayers > matchSize {
+		return fmt.Errorf("bot fill needs at most %d players", matchSize)
+	}
+	if c.Rating < 0 {
+		return fmt.Errorf("bot rating must not be negative")
+	}
+	return nil
+}
+
+func isBot(playerID string) bool {
+	return strings.HasPrefix(playerID, botPrefix)
+}
+
+// newBots returns n bots with the given rating. Bots take any role.
+func newBots(n int, rating float64) []TicketPlayer {
+	bots := make([]TicketPlayer, n)
+	for i := range bots {
+		bots[i] = TicketPlayer{
+			PlayerID:    botPrefix + uuid.New().String()[:8],
+			Rating:      rating,
+			Uncertainty: defaultUncertainty,
+			Roles:       []string{roleFill},
+		}
+	}
+	return bots
+}
+
+// botTickets wraps bots into tickets of their own, so that they are split into
+// teams together with the players.
+func botTickets(bots []TicketPlayer) []queuedTicket {
+	tickets := make([]queuedTicket, len(bots))
+	for i, b := range bots {
+		tickets[i] = queuedTicket{ID: b.PlayerID, Ticket: Ticket{
+			Players:     []TicketPlayer{b},
+			Status:      StatusMatching,
+			Rating:      b.Rating,
+			Uncertainty: b.Uncertainty,
+			Bot:         true,
+		}}
+	}
+	return tickets
+}
+
+// proposeWithBots proposes a bot-filled match once the oldest ticket not in
+// any proposal has waited long enough. The oldest ticket is joined by the
+// next oldest that fit: keeping the group's rating spread within its search
+// window, able to play in its closest region and, in role queues, able to
+// fill the composition together. Bots take the remaining slots. It returns nil if the queue has
+// no bot fill or no such match can be formed.
+func proposeWithBots(q *QueueConfig, tickets []queuedTicket, proposals []Proposal, regions []string, now time.Time) *Proposal {
+	if q.BotFill == nil {
+		return nil
+	}
+
+	var waiting []queuedTicket
+	for _, t := range tickets {
+		if !slices.ContainsFunc(proposals, func(p Proposal) bool {
+			return slices.ContainsFunc(p.Tickets, func(pt queuedTicket) bool { return pt.ID == t.ID })
+		}) {
+			waiting = append(waiting, t)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return waiting[i].queuedSince().Before(waiting[j].queuedSince())
+	})
+	oldest := waiting[0]
+	if now.Sub(oldest.queuedSince()) < time.Duration(q.BotFill.After) {
+		return nil
+	}
+
+	region := closestRegion([]queuedTicket{oldest}, regions)
+	group := []queuedTicket{oldest}
+	for _, t := range waiting[1:] {
+		if slotsUsed(group)+t.Size() > q.MatchSize() {
+			continue
+		}
+		candidate := append(slices.Clip(group), t)
+		if q.SearchWindow != nil && ratingSpread(candidate) > groupWindow(candidate, *q.SearchWindow, now) {
+			continue
+		}
+		if q.PingWindow != nil && region != "" && !acceptablePing(t, region, *q.PingWindow, now) {
+			continue
+		}
+		if q.Roles != nil && !q.Roles.fits(candidate, q.TeamCount) {
+			continue
+		}
+		group = candidate
+	}
+
+	bots := fillWithBots(q, group)
+	if bots == nil {
+		return nil
+	}
+	return &Proposal{Tickets: group, Region: region, Bots: bots}
+}
+
+// fillWithBots returns the bots completing a group of tickets to a full match,
+// or nil if the group has too few players or cannot be split into teams.
+func fillWithBots(q *QueueConfig, group []queuedTicket) []TicketPlayer {
+	players := slotsUsed(group)
+	if players < q.BotFill.MinPlayers || players >= q.MatchSize() {
+		return nil
+	}
+
+	rating := q.BotFill.Rating
+	if rating == 0 {
+		for _, t := range group {
+			for _, p := range t.Players {
+				rating += p.Rating / float64(players)
+			}
+		}
+	}
+	bots := newBots(q.MatchSize()-players, rating)
+	// Parties still have to fit on a team
+	if balanceTeams(append(slices.Clip(group), botTickets(bots)...), q.TeamCount, q.TeamSize, q.Roles) == nil {
+		return nil
+	}
+	return bots
+}
+
+// claimWithBots claims the tickets of a bot-filled proposal. Slots of tickets
+// that are gone go to further bots instead of other tickets. It returns nil if
+// too few players are left.
+func claimWithBots(ctx context.Context, q *QueueConfig, p Proposal) ([]queuedTicket, []TicketPlayer, error) {
+	claimed, err := claimTickets(ctx, q, p.Tickets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(claimed) == len(p.Tickets) {
+		return claimed, p.Bots, nil
+	}
+
+	bots := fillWithBots(q, claimed)
+	if bots == nil {
+		return nil, nil, releaseTickets(ctx, q, StatusMatching, claimed, nil)
+	}
+	return claimed, bots, nil
+}
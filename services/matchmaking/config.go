@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// QueueConfig describes a single game mode and how its matches are formed.
+type QueueConfig struct {
+	Name      string `json:"name"`
+	TeamCount int    `json:"teamCount"`
+	TeamSize  int    `json:"teamSize"`
+	// SearchWindow limits the rating spread of a match. Without it ratings are
+	// ignored and tickets are matched in queue order.
+	SearchWindow *WindowCurve `json:"searchWindow,omitempty"`
+	// PingWindow limits the ping (ms) players may have to the match's region.
+	// Without it tickets are grouped regardless of region and the match is
+	// placed where its players have the lowest ping.
+	PingWindow *WindowCurve `json:"pingWindow,omitempty"`
+	// Roles requires every team to fill a role composition from the roles the
+	// players queued with.
+	Roles *RoleConfig `json:"roles,omitempty"`
+	// BotFill starts matches with bots once the oldest ticket has waited too
+	// long for a full match.
+	BotFill *BotFillConfig `json:"botFill,omitempty"`
+	// GameDuration is passed to the game server started for each match.
+	GameDuration Duration `json:"gameDuration"`
+}
+
+// Key returns the Redis list holding the queued ticket IDs.
+func (q *QueueConfig) Key() string {
+	return "queue:" + q.Name
+}
+
+// MatchSize returns the number of players in a full match.
+func (q *QueueConfig) MatchSize() int {
+	return q.TeamCount * q.TeamSize
+}
+
+type Config struct {
+	DefaultQueue    string           `json:"defaultQueue"`
+	Regions         []string         `json:"regions"` // regions the orchestrator can place servers in
+	Queues          []*QueueConfig   `json:"queues"`
+	AllocationRetry RetryConfig      `json:"allocationRetry"`
+	WorkerLease     LeaseConfig      `json:"workerLease"`
+	ReadyCheck      ReadyCheckConfig `json:"readyCheck"`
+	Penalties       PenaltyConfig    `json:"penalties"`
+	Ratings         RatingConfig     `json:"ratings"`
+	Tickets         TicketConfig     `json:"tickets"`
+}
+
+// Queue returns the queue with the given name, falling back to the default queue for an empty name.
+func (c *Config) Queue(name string) (*QueueConfig, bool) {
+	if name == "" {
+		name = c.DefaultQueue
+	}
+	for _, q := range c.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return nil, false
+}
+
+// loadConfig reads and validates the queue configuration file.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if len(cfg.Queues) == 0 {
+		return nil, fmt.Errorf("no queues configured")
+	}
+	seen := make(map[string]bool)
+	for _, q := range cfg.Queues {
+		if q.Name == "" {
+			return nil, fmt.Errorf("queue without name")
+		}
+		if seen[q.Name] {
+			return nil, fmt.Errorf("duplicate queue %q", q.Name)
+		}
+		seen[q.Name] = true
+
+		if q.TeamCount < 2 || q.TeamSize < 1 {
+			return nil, fmt.Errorf("queue %q needs at least 2 teams of 1 player", q.Name)
+		}
+		if q.SearchWindow != nil {
+			if err := q.SearchWindow.validate(); err != nil {
+				return nil, fmt.Errorf("queue %q: %w", q.Name, err)
+			}
+		}
+		if q.PingWindow != nil {
+			if len(cfg.Regions) == 0 {
+				return nil, fmt.Errorf("queue %q has a ping window but no regions are configured", q.Name)
+			}
+			if err := q.PingWindow.validate(); err != nil {
+				return nil, fmt.Errorf("queue %q ping window: %w", q.Name, err)
+			}
+		}
+		if q.Roles != nil {
+			if err := q.Roles.validate(q.TeamSize); err != nil {
+				return nil, fmt.Errorf("queue %q roles: %w", q.Name, err)
+			}
+		}
+		if q.BotFill != nil {
+			if err := q.BotFill.validate(q.MatchSize()); err != nil {
+				return nil, fmt.Errorf("queue %q: %w", q.Name, err)
+			}
+		}
+		if q.GameDuration <= 0 {
+			q.GameDuration = Duration(30 * time.Second)
+		}
+	}
+
+	if cfg.AllocationRetry.MaxAttempts <= 0 {
+		cfg.AllocationRetry.MaxAttempts = 3
+	}
+	if cfg.AllocationRetry.Backoff <= 0 {
+		cfg.AllocationRetry.Backoff = Duration(time.Second)
+	}
+	if cfg.AllocationRetry.MaxBackoff < cfg.AllocationRetry.Backoff {
+		cfg.AllocationRetry.MaxBackoff = cfg.AllocationRetry.Backoff * 10
+	}
+
+	if cfg.ReadyCheck.Timeout <= 0 {
+		cfg.ReadyCheck.Timeout = Duration(10 * time.Second)
+	}
+
+	if cfg.Penalties.Window <= 0 {
+		cfg.Penalties.Window = Duration(24 * time.Hour)
+	}
+	if err := cfg.Penalties.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Ratings.Algorithm == "" {
+		cfg.Ratings.Algorithm = algorithmGlicko2
+	}
+	if cfg.Ratings.HistoryLength <= 0 {
+		cfg.Ratings.HistoryLength = 100
+	}
+
+	if cfg.Tickets.HeartbeatTimeout <= 0 {
+		cfg.Tickets.HeartbeatTimeout = Duration(30 * time.Second)
+	}
+	if cfg.Tickets.SweepInterval <= 0 {
+		cfg.Tickets.SweepInterval = Duration(5 * time.Second)
+	}
+
+	if cfg.WorkerLease.TTL <= 0 {
+		cfg.WorkerLease.TTL = Duration(5 * time.Second)
+	}
+
+	if cfg.DefaultQueue == "" {
+		cfg.DefaultQueue = cfg.Queues[0].Name
+	}
+	if !seen[cfg.DefaultQueue] {
+		return nil, fmt.Errorf("default queue %q is not configured", cfg.DefaultQueue)
+	}
+	return &cfg, nil
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "math"
+
+// elo rates each player by the result of their team against every other team,
+// expecting the outcome from the teams' average ratings. Elo has no notion of
+// uncertainty, so it is left as it is.
+type elo struct {
+	k float64
+}
+
+func (e elo) Update(teams [][]Rating, ranks []int) [][]Rating {
+	averages := make([]float64, len(teams))
+	for i, team := range teams {
+		averages[i], _ = teamAverage(team)
+	}
+
+	updated := make([][]Rating, len(teams))
+	for i, team := range teams {
+		var delta float64
+		for j := range teams {
+			if j == i {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, (averages[j]-averages[i])/400))
+			delta += outcome(ranks, i, j) - expected
+		}
+		// Spread the K factor over the opponents so a match counts once
+		delta *= e.k / float64(len(teams)-1)
+
+		updated[i] = make([]Rating, len(team))
+		for p, r := range team {
+			r.Rating += delta
+			updated[i][p] = r
+		}
+	}
+	return updated
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// waitSamples is how many recent queue times are kept per statistic.
+	waitSamples = 200
+	// minWaitSamples is how many queue times a statistic needs before it is
+	// used for estimates; sparser ones fall back to a coarser statistic.
+	minWaitSamples = 10
+	// waitStatsTTL drops statistics of queues that have not matched anyone for a while.
+	waitStatsTTL = time.Hour
+	// ratingBucketSize groups tickets by rating for the statistics.
+	ratingBucketSize = 200
+)
+
+// WaitEstimate is the expected time until a ticket is matched, with the range
+// that 80% of recent comparable tickets fell into.
+type WaitEstimate struct {
+	Seconds float64 `json:"seconds"` // median
+	Low     float64 `json:"low"`     // 10th percentile
+	High    float64 `json:"high"`    // 90th percentile
+	Samples int     `json:"samples"` // recent queue times the estimate is based on
+}
+
+// waitStatsKeys returns the lists of recent queue times that apply to a
+// ticket, most specific first: by queue, rating bucket and region, by queue
+// and rating bucket, and by queue alone.
+func waitStatsKeys(q *QueueConfig, t Ticket) []string {
+	bucket := strconv.Itoa(int(math.Floor(t.Rating/ratingBucketSize)) * ratingBucketSize)
+	region := closestRegion([]queuedTicket{{Ticket: t}}, config.Regions)
+	if region == "" {
+		region = "any"
+	}
+	base := "waits:" + q.Name
+	return []string{base + ":" + bucket + ":" + region, base + ":" + bucket, base}
+}
+
+// recordWaits adds the queue times of a matched group to the statistics and
+// compares them with the estimates the tickets were given when they joined.
+func recordWaits(ctx context.Context, q *QueueConfig, group []queuedTicket) error {
+	pipe := rdb.Pipeline()
+	for _, t := range group {
+		waited := time.Since(t.CreatedAt)
+		for _, key := range waitStatsKeys(q, t.Ticket) {
+			pipe.LPush(ctx, key, waited.Milliseconds())
+			pipe.LTrim(ctx, key, 0, waitSamples-1)
+			pipe.Expire(ctx, key, waitStatsTTL)
+		}
+
+		if t.WaitEstimate == nil {
+			waitEstimates.WithLabelValues(q.Name, "none").Inc()
+			continue
+		}
+		seconds := waited.Seconds()
+		waitEstimateError.WithLabelValues(q.Name).Observe(seconds - t.WaitEstimate.Seconds)
+		switch {
+		case seconds < t.WaitEstimate.Low:
+			waitEstimates.WithLabelValues(q.Name, "shorter").Inc()
+		case seconds > t.WaitEstimate.High:
+			waitEstimates.WithLabelValues(q.Name, "longer").Inc()
+		default:
+			waitEstimates.WithLabelValues(q.Name, "within").Inc()
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// estimateWait estimates how much longer a ticket that has already waited for
+// the given time will wait, from the recent queue times of comparable tickets
+// that waited at least as long. Tickets in low priority add what is left of
+// their delay. It returns nil if there are not enough recent queue times.
+func estimateWait(ctx context.Context, q *QueueConfig, t Ticket, waited time.Duration) (*WaitEstimate, error) {
+	keys := waitStatsKeys(q, t)
+	pipe := rdb.Pipeline()
+	lists := make([]*redis.StringSliceCmd, len(keys))
+	for i, key := range keys {
+		lists[i] = pipe.LRange(ctx, key, 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, list := range lists {
+		var remaining []float64
+		for _, val := range list.Val() {
+			ms, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				continue
+			}
+			if w := time.Duration(ms) * time.Millisecond; w >= waited {
+				remaining = append(remaining, (w - waited).Seconds())
+			}
+		}
+		if len(remaining) < minWaitSamples {
+			continue
+		}
+
+		sort.Float64s(remaining)
+		delay := 0.0
+		if t.LowPriority {
+			delay = math.Max(time.Until(t.RetryAt).Seconds(), 0)
+		}
+		return &WaitEstimate{
+			Seconds: percentile(remaining, 0.5) + delay,
+			Low:     percentile(remaining, 0.1) + delay,
+			High:    percentile(remaining, 0.9) + delay,
+			Samples: len(remaining),
+		}, nil
+	}
+	return nil, nil
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	return sorted[int(math.Round(p*float64(len(sorted)-1)))]
+}
@@ -0,0 +1,106 @@
+package main
+
+import "math"
+
+// glicko2Scale converts between the Glicko and Glicko-2 scales.
+const glicko2Scale = 173.7178
+
+// glicko2 rates each player as if they had played one game against every
+// other team, with the team's average rating and uncertainty as the opponent
+// (Glickman, "Example of the Glicko-2 system"). The player's own team average
+// stands in for the player when predicting the outcome, so a strong player is
+// not punished for weak teammates, while the change is applied to the
+// player's own rating, uncertainty and volatility.
+type glicko2 struct {
+	tau float64
+}
+
+func (g glicko2) Update(teams [][]Rating, ranks []int) [][]Rating {
+	mus := make([]float64, len(teams))
+	phis := make([]float64, len(teams))
+	for i, team := range teams {
+		rating, uncertainty := teamAverage(team)
+		mus[i] = (rating - defaultRating) / glicko2Scale
+		phis[i] = uncertainty / glicko2Scale
+	}
+
+	updated := make([][]Rating, len(teams))
+	for i, team := range teams {
+		// Variance and improvement estimated from the games against every opponent
+		var invV, sum float64
+		for j := range teams {
+			if j == i {
+				continue
+			}
+			gj := glicko2G(phis[j])
+			expected := 1 / (1 + math.Exp(-gj*(mus[i]-mus[j])))
+			invV += gj * gj * expected * (1 - expected)
+			sum += gj * (outcome(ranks, i, j) - expected)
+		}
+		v := 1 / invV
+		delta := v * sum
+
+		updated[i] = make([]Rating, len(team))
+		for p, r := range team {
+			mu := (r.Rating - defaultRating) / glicko2Scale
+			phi := r.Uncertainty / glicko2Scale
+			sigma := g.volatility(phi, r.Volatility, v, delta)
+
+			phiStar := math.Sqrt(phi*phi + sigma*sigma)
+			newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+			mu += newPhi * newPhi * sum
+
+			updated[i][p] = Rating{
+				Rating:      mu*glicko2Scale + defaultRating,
+				Uncertainty: math.Min(newPhi*glicko2Scale, defaultUncertainty),
+				Volatility:  sigma,
+			}
+		}
+	}
+	return updated
+}
+
+func glicko2G(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// volatility finds the new volatility with the Illinois algorithm (step 5 of
+// the Glicko-2 paper).
+func (g glicko2) volatility(phi, sigma, v, delta float64) float64 {
+	const epsilon = 0.000001
+	if sigma <= 0 {
+		sigma = defaultVolatility
+	}
+
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(g.tau*g.tau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*g.tau) < 0 {
+			k++
+		}
+		B = a - k*g.tau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > epsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LeaseConfig controls how queue ownership is shared between replicas.
+type LeaseConfig struct {
+	TTL Duration `json:"ttl"` // a lease not renewed within this time is taken over by another replica
+}
+
+// renewScript extends the lease in KEYS[1] by ARGV[2] milliseconds if it is
+// still held by ARGV[1].
+var renewScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	return 0
+`)
+
+// releaseScript deletes the lease in KEYS[1] if it is still held by ARGV[1].
+var releaseScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// queueLease makes sure only one matchmaking replica runs the worker of a
+// queue at a time. The lease is a Redis key holding the owner's instance ID
+// with a TTL. The owner renews it periodically; if the owner dies, the key
+// expires and another replica picks the queue up.
+type queueLease struct {
+	q        *QueueConfig
+	instance string
+	ttl      time.Duration
+	held     atomic.Bool
+	// validUntil is when the lease runs out unless it is renewed, in Unix
+	// nanoseconds, counted from before the last acquire or renew call
+	validUntil atomic.Int64
+}
+
+func newQueueLease(q *QueueConfig, instance string, ttl time.Duration) *queueLease {
+	return &queueLease{q: q, instance: instance, ttl: ttl}
+}
+
+func (l *queueLease) key() string {
+	return "lease:" + l.q.Key()
+}
+
+// Held reports whether this instance currently owns the queue. A lease that
+// was not renewed in time is no longer held, even before the next renewal
+// notices, since another replica may have taken it over.
+func (l *queueLease) Held() bool {
+	return l.held.Load() && time.Now().UnixNano() < l.validUntil.Load()
+}
+
+// run acquires and renews the lease until ctx is done, then releases it.
+func (l *queueLease) run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		l.tick(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if l.held.Load() {
+				releaseScript.Run(context.Background(), rdb, []string{l.key()}, l.instance)
+				l.set(false)
+			}
+			return
+		}
+	}
+}
+
+func (l *queueLease) tick(ctx context.Context) {
+	start := time.Now()
+	if l.held.Load() {
+		renewed, err := renewScript.Run(ctx, rdb, []string{l.key()}, l.instance, l.ttl.Milliseconds()).Int()
+		if err != nil {
+			// Stop working the queue: if Redis is unreachable we cannot tell
+			// whether another replica took over once the TTL ran out.
+			log.Printf("[%s] Renewing lease failed: %v", l.q.Name, err)
+			l.set(false)
+			return
+		}
+		if renewed == 0 {
+			log.Printf("[%s] Lease lost", l.q.Name)
+			l.set(false)
+			return
+		}
+		l.validUntil.Store(start.Add(l.ttl).UnixNano())
+		return
+	}
+
+	acquired, err := rdb.SetNX(ctx, l.key(), l.instance, l.ttl).Result()
+	if err != nil {
+		log.Printf("[%s] Acquiring lease failed: %v", l.q.Name, err)
+		return
+	}
+	if acquired {
+		log.Printf("[%s] Lease acquired by %s", l.q.Name, l.instance)
+		l.validUntil.Store(start.Add(l.ttl).UnixNano())
+		l.set(true)
+	}
+}
+
+func (l *queueLease) set(held bool) {
+	if l.held.Swap(held) == held {
+		return
+	}
+	if held {
+		leaseOwned.WithLabelValues(l.q.Name, l.instance).Set(1)
+		leaseChanges.WithLabelValues(l.q.Name, "acquired").Inc()
+	} else {
+		leaseOwned.WithLabelValues(l.q.Name, l.instance).Set(0)
+		leaseChanges.WithLabelValues(l.q.Name, "lost").Inc()
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Lobby states. A lobby is open until its owner starts it; it is kept after
+// the start so that members can read the server.
+const (
+	lobbyOpen     = "open"
+	lobbyStarting = "starting"
+	lobbyStarted  = "started"
+)
+
+const (
+	// lobbyTTL is how long a lobby lives after its last change.
+	lobbyTTL = time.Hour
+	// lobbyCodeAlphabet leaves out characters that are easily confused.
+	lobbyCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	lobbyCodeLength   = 6
+	// maxLobbyRetries limits how often a change is retried when the lobby
+	// changed concurrently.
+	maxLobbyRetries   = 5
+	maxLobbyTeamCount = 8
+	maxLobbyTeamSize  = 10
+	maxLobbyDuration  = time.Hour
+)
+
+// LobbySettings are chosen by the owner when creating a private lobby.
+type LobbySettings struct {
+	Mode         string   `json:"mode"`
+	Map          string   `json:"map,omitempty"`
+	TeamCount    int      `json:"teamCount"`
+	TeamSize     int      `json:"teamSize"`
+	Region       string   `json:"region,omitempty"`
+	GameDuration Duration `json:"gameDuration"`
+}
+
+type LobbyMember struct {
+	PlayerID string    `json:"playerId"`
+	Team     int       `json:"team"`
+	Ready    bool      `json:"ready"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Lobby is a private match that players join by invite code instead of
+// queueing, stored under lobby:{code}.
+type Lobby struct {
+	Code      string        `json:"code"`
+	Owner     string        `json:"owner"`
+	Settings  LobbySettings `json:"settings"`
+	Members   []LobbyMember `json:"members"` // in joining order
+	Status    string        `json:"status"`
+	MatchID   string        `json:"matchId,omitempty"`
+	Server    *ServerInfo   `json:"server,omitempty"` // set once started
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+type LobbyRequest struct {
+	PlayerID string         `json:"id"`
+	Code     string         `json:"code,omitempty"`
+	Settings *LobbySettings `json:"settings,omitempty"` // create
+	Team     *int           `json:"team,omitempty"`     // team
+	Ready    *bool          `json:"ready,omitempty"`    // ready
+}
+
+func lobbyKey(code string) string {
+	return "lobby:" + code
+}
+
+// playerLobbyKey points a player at the open lobby they are in.
+func playerLobbyKey(playerID string) string {
+	return "player:" + playerID + ":lobby"
+}
+
+func (l *Lobby) member(playerID string) *LobbyMember {
+	for i := range l.Members {
+		if l.Members[i].PlayerID == playerID {
+			return &l.Members[i]
+		}
+	}
+	return nil
+}
+
+func (l *Lobby) teamCounts() []int {
+	counts := make([]int, l.Settings.TeamCount)
+	for _, m := range l.Members {
+		counts[m.Team]++
+	}
+	return counts
+}
+
+func (s *LobbySettings) validate() error {
+	if s.Mode == "" {
+		s.Mode = "custom"
+	}
+	if s.TeamCount == 0 {
+		s.TeamCount = 2
+	}
+	if s.TeamSize == 0 {
+		s.TeamSize = 5
+	}
+	if s.GameDuration == 0 {
+		s.GameDuration = Duration(30 * time.Second)
+	}
+	if s.TeamCount < 2 || s.TeamCount > maxLobbyTeamCount || s.TeamSize < 1 || s.TeamSize > maxLobbyTeamSize {
+		return fmt.Errorf("lobbies need 2 to %d teams of 1 to %d players", maxLobbyTeamCount, maxLobbyTeamSize)
+	}
+	if s.GameDuration < 0 || time.Duration(s.GameDuration) > maxLobbyDuration {
+		return fmt.Errorf("game duration must be at most %s", maxLobbyDuration)
+	}
+	if s.Region != "" && !slices.Contains(config.Regions, s.Region) {
+		return fmt.Errorf("unknown region %q", s.Region)
+	}
+	return nil
+}
+
+// lobbyError is a change that was refused, answered with its status code.
+type lobbyError struct {
+	status int
+	msg    string
+}
+
+func (e *lobbyError) Error() string { return e.msg }
+
+func refuse(status int, format string, args ...interface{}) error {
+	return &lobbyError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errCorruptLobby = errors.New("corrupt lobby")
+	errLobbyBusy    = errors.New("lobby changed concurrently")
+	// errLobbyCodeTaken makes lobby creation retry with another code
+	errLobbyCodeTaken = errors.New("lobby code taken")
+)
+
+// updateLobby applies a change to a lobby under optimistic locking and keeps
+// the lobby pointer of the player making it in sync: it points at the lobby
+// while the player is a member, and a player can only be in one open lobby.
+// A lobby without members is deleted. It returns redis.Nil if the lobby does
+// not exist.
+func updateLobby(ctx context.Context, code, playerID string, change func(l *Lobby) error) (*Lobby, error) {
+	key, pointerKey := lobbyKey(code), playerLobbyKey(playerID)
+	var lobby Lobby
+	for attempt := 0; attempt < maxLobbyRetries; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			val, err := tx.Get(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			lobby = Lobby{}
+			if err := json.Unmarshal([]byte(val), &lobby); err != nil {
+				return fmt.Errorf("%w %s: %v", errCorruptLobby, code, err)
+			}
+			wasMember := lobby.member(playerID) != nil
+			if err := change(&lobby); err != nil {
+				return err
+			}
+			isMember := lobby.member(playerID) != nil
+
+			if isMember && !wasMember {
+				if err := checkNotInLobby(ctx, tx, playerID); err != nil {
+					return err
+				}
+			}
+
+			data, err := json.Marshal(lobby)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if len(lobby.Members) == 0 {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, data, lobbyTTL)
+				}
+				if isMember && lobby.Status == lobbyOpen {
+					pipe.Set(ctx, pointerKey, code, lobbyTTL)
+				} else if wasMember {
+					pipe.Del(ctx, pointerKey)
+				}
+				return nil
+			})
+			return err
+		}, key, pointerKey)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &lobby, nil
+	}
+	return nil, errLobbyBusy
+}
+
+// checkNotInLobby refuses players who are already in another open lobby.
+// Pointers at lobbies that no longer exist are ignored.
+func checkNotInLobby(ctx context.Context, tx *redis.Tx, playerID string) error {
+	other, err := tx.Get(ctx, playerLobbyKey(playerID)).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	exists, err := tx.Exists(ctx, lobbyKey(other)).Result()
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return refuse(http.StatusConflict, "player is already in lobby %s", other)
+	}
+	return nil
+}
+
+func newLobbyCode() (string, error) {
+	code := make([]byte, lobbyCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(lobbyCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = lobbyCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// decodeLobbyRequest reads a lobby request and checks that it names a player
+// and, unless creating, a lobby. On failure it writes the error response.
+func decodeLobbyRequest(w http.ResponseWriter, r *http.Request, needCode bool) (LobbyRequest, bool) {
+	var req LobbyRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return req, false
+	}
+	if req.PlayerID == "" || (needCode && req.Code == "") {
+		http.Error(w, "id and code are required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// writeLobby answers a lobby request with the lobby or the error of the change.
+func writeLobby(w http.ResponseWriter, lobby *Lobby, err error) {
+	var refused *lobbyError
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lobby)
+	case errors.As(err, &refused):
+		http.Error(w, refused.msg, refused.status)
+	case err == redis.Nil:
+		http.Error(w, "Lobby not found", http.StatusNotFound)
+	case errors.Is(err, errCorruptLobby):
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+	case errors.Is(err, errLobbyBusy):
+		http.Error(w, "Lobby is busy, try again", http.StatusConflict)
+	default:
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// requireOpen refuses changes to lobbies that are starting or started.
+func requireOpen(l *Lobby) error {
+	if l.Status != lobbyOpen {
+		return refuse(http.StatusConflict, "lobby is %s", l.Status)
+	}
+	return nil
+}
+
+// handleLobby returns a lobby by code; members poll it for the server once
+// the lobby started.
+func handleLobby(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "code required", http.StatusBadRequest)
+		return
+	}
+
+	val, err := rdb.Get(r.Context(), lobbyKey(code)).Result()
+	if err != nil {
+		writeLobby(w, nil, err)
+		return
+	}
+	var lobby Lobby
+	if err := json.Unmarshal([]byte(val), &lobby); err != nil {
+		writeLobby(w, nil, fmt.Errorf("%w %s: %v", errCorruptLobby, code, err))
+		return
+	}
+	writeLobby(w, &lobby, nil)
+}
+
+// handleLobbyCreate creates a lobby owned by the player, who joins the first
+// team, and returns it with its invite code.
+func handleLobbyCreate(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	if isBot(req.PlayerID) {
+		http.Error(w, fmt.Sprintf("player IDs starting with %q are reserved for bots", botPrefix), http.StatusBadRequest)
+		return
+	}
+	settings := LobbySettings{}
+	if req.Settings != nil {
+		settings = *req.Settings
+	}
+	if err := settings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now()
+	for attempt := 0; attempt < maxLobbyRetries; attempt++ {
+		code, err := newLobbyCode()
+		if err != nil {
+			writeLobby(w, nil, err)
+			return
+		}
+		lobby := Lobby{
+			Code:      code,
+			Owner:     req.PlayerID,
+			Settings:  settings,
+			Members:   []LobbyMember{{PlayerID: req.PlayerID, JoinedAt: now}},
+			Status:    lobbyOpen,
+			CreatedAt: now,
+		}
+		data, err := json.Marshal(lobby)
+		if err != nil {
+			writeLobby(w, nil, err)
+			return
+		}
+
+		err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+			if err := checkNotInLobby(ctx, tx, req.PlayerID); err != nil {
+				return err
+			}
+			taken, err := tx.Exists(ctx, lobbyKey(code)).Result()
+			if err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errLobbyCodeTaken
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, lobbyKey(code), data, lobbyTTL)
+				pipe.Set(ctx, playerLobbyKey(req.PlayerID), code, lobbyTTL)
+				return nil
+			})
+			return err
+		}, lobbyKey(code), playerLobbyKey(req.PlayerID))
+		if err == redis.TxFailedErr || err == errLobbyCodeTaken {
+			continue
+		}
+		if err != nil {
+			writeLobby(w, nil, err)
+			return
+		}
+
+		lobbiesCreated.WithLabelValues(settings.Mode).Inc()
+		log.Printf("Lobby %s created by %s (%s, %dx%d)", code, req.PlayerID, settings.Mode, settings.TeamCount, settings.TeamSize)
+		writeLobby(w, &lobby, nil)
+		return
+	}
+	writeLobby(w, nil, errLobbyBusy)
+}
+
+// handleLobbyJoin adds the player to the team with the fewest members.
+func handleLobbyJoin(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if isBot(req.PlayerID) {
+		http.Error(w, fmt.Sprintf("player IDs starting with %q are reserved for bots", botPrefix), http.StatusBadRequest)
+		return
+	}
+
+	lobby, err := updateLobby(r.Context(), req.Code, req.PlayerID, func(l *Lobby) error {
+		if err := requireOpen(l); err != nil {
+			return err
+		}
+		if l.member(req.PlayerID) != nil {
+			return nil
+		}
+		counts := l.teamCounts()
+		team := 0
+		for i, n := range counts {
+			if n < counts[team] {
+				team = i
+			}
+		}
+		if counts[team] >= l.Settings.TeamSize {
+			return refuse(http.StatusConflict, "lobby is full")
+		}
+		l.Members = append(l.Members, LobbyMember{PlayerID: req.PlayerID, Team: team, JoinedAt: time.Now()})
+		return nil
+	})
+	writeLobby(w, lobby, err)
+}
+
+// handleLobbyTeam moves the player to another team that has room. Switching
+// teams clears the player's ready flag.
+func handleLobbyTeam(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if req.Team == nil {
+		http.Error(w, "team required", http.StatusBadRequest)
+		return
+	}
+
+	lobby, err := updateLobby(r.Context(), req.Code, req.PlayerID, func(l *Lobby) error {
+		if err := requireOpen(l); err != nil {
+			return err
+		}
+		m := l.member(req.PlayerID)
+		if m == nil {
+			return refuse(http.StatusForbidden, "player is not in the lobby")
+		}
+		team := *req.Team
+		if team < 0 || team >= l.Settings.TeamCount {
+			return refuse(http.StatusBadRequest, "team must be between 0 and %d", l.Settings.TeamCount-1)
+		}
+		if m.Team == team {
+			return nil
+		}
+		if l.teamCounts()[team] >= l.Settings.TeamSize {
+			return refuse(http.StatusConflict, "team %d is full", team)
+		}
+		m.Team = team
+		m.Ready = false
+		return nil
+	})
+	writeLobby(w, lobby, err)
+}
+
+// handleLobbyReady sets the player's ready flag.
+func handleLobbyReady(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if req.Ready == nil {
+		http.Error(w, "ready required", http.StatusBadRequest)
+		return
+	}
+
+	lobby, err := updateLobby(r.Context(), req.Code, req.PlayerID, func(l *Lobby) error {
+		if err := requireOpen(l); err != nil {
+			return err
+		}
+		m := l.member(req.PlayerID)
+		if m == nil {
+			return refuse(http.StatusForbidden, "player is not in the lobby")
+		}
+		m.Ready = *req.Ready
+		return nil
+	})
+	writeLobby(w, lobby, err)
+}
+
+// handleLobbyLeave removes the player from the lobby. Ownership passes to the
+// member who joined first after the owner; the last one out closes the lobby.
+func handleLobbyLeave(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	lobby, err := updateLobby(r.Context(), req.Code, req.PlayerID, func(l *Lobby) error {
+		if err := requireOpen(l); err != nil {
+			return err
+		}
+		l.Members = slices.DeleteFunc(l.Members, func(m LobbyMember) bool { return m.PlayerID == req.PlayerID })
+		if l.Owner == req.PlayerID && len(l.Members) > 0 {
+			l.Owner = l.Members[0].PlayerID
+		}
+		return nil
+	})
+	writeLobby(w, lobby, err)
+}
+
+// handleLobbyStart lets the owner start the lobby once every member is ready
+// and every team has a player. It allocates a server like a queued match and
+// hands it to all members through the lobby. Lobby games are not rated, and
+// leavers get no penalty and no backfill.
+func handleLobbyStart(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeLobbyRequest(w, r, true)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	// Claim the start so that it only happens once
+	lobby, err := updateLobby(ctx, req.Code, req.PlayerID, func(l *Lobby) error {
+		if err := requireOpen(l); err != nil {
+			return err
+		}
+		if l.Owner != req.PlayerID {
+			return refuse(http.StatusForbidden, "only the owner can start the lobby")
+		}
+		for _, m := range l.Members {
+			if !m.Ready {
+				return refuse(http.StatusConflict, "player %s is not ready", m.PlayerID)
+			}
+		}
+		for team, n := range l.teamCounts() {
+			if n == 0 {
+				return refuse(http.StatusConflict, "team %d has no players", team)
+			}
+		}
+		l.Status = lobbyStarting
+		return nil
+	})
+	if err != nil {
+		writeLobby(w, nil, err)
+		return
+	}
+
+	players := make([]GamePlayer, len(lobby.Members))
+	for i, m := range lobby.Members {
+		players[i] = GamePlayer{ID: m.PlayerID, Team: m.Team}
+	}
+	serverInfo, err := allocateServer(lobby.Settings.GameDuration, lobby.Settings.Region, lobby.Settings.Map, players, nil)
+	if err != nil {
+		log.Printf("Starting lobby %s failed: %v", lobby.Code, err)
+		reopenLobby(ctx, lobby, req.PlayerID)
+		http.Error(w, "Failed to allocate a game server", http.StatusBadGateway)
+		return
+	}
+
+	var started *Lobby
+	err = saveLobbyMatch(ctx, lobby, serverInfo)
+	if err == nil {
+		matchID := lobby.MatchID
+		started, err = updateLobby(ctx, req.Code, req.PlayerID, func(l *Lobby) error {
+			l.Status = lobbyStarted
+			l.MatchID = matchID
+			l.Server = &serverInfo
+			return nil
+		})
+	}
+	if err != nil {
+		// Nobody is sent to the server, so it would idle until its game ends
+		log.Printf("Starting lobby %s failed: %v", lobby.Code, err)
+		if rerr := releaseServer(serverInfo.GameID); rerr != nil {
+			log.Printf("Releasing game server of lobby %s failed: %v", lobby.Code, rerr)
+		}
+		rdb.Del(ctx, "match:"+lobby.MatchID, gameMatchKey(serverInfo.GameID))
+		reopenLobby(ctx, lobby, req.PlayerID)
+		writeLobby(w, nil, err)
+		return
+	}
+	lobby = started
+
+	// Members are free to queue or join other lobbies while they play
+	pipe := rdb.Pipeline()
+	for _, m := range lobby.Members {
+		pipe.Del(ctx, playerLobbyKey(m.PlayerID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Redis error: %v", err)
+	}
+
+	lobbyStarts.WithLabelValues(lobby.Settings.Mode, "started").Inc()
+	log.Printf("Lobby %s started on game %s with %d players", lobby.Code, serverInfo.GameID, len(lobby.Members))
+	writeLobby(w, lobby, nil)
+}
+
+// reopenLobby returns a lobby whose start failed to the open state.
+func reopenLobby(ctx context.Context, lobby *Lobby, playerID string) {
+	lobbyStarts.WithLabelValues(lobby.Settings.Mode, "failed").Inc()
+	if _, err := updateLobby(ctx, lobby.Code, playerID, func(l *Lobby) error {
+		l.Status = lobbyOpen
+		return nil
+	}); err != nil {
+		log.Printf("Reopening lobby %s failed: %v", lobby.Code, err)
+	}
+}
+
+// saveLobbyMatch stores the match of a started lobby, so that reports and
+// results from its game server find it. It sets the lobby's match ID.
+func saveLobbyMatch(ctx context.Context, lobby *Lobby, serverInfo ServerInfo) error {
+	lobby.MatchID = uuid.New().String()
+	match := Match{
+		MatchID:   lobby.MatchID,
+		Lobby:     lobby.Code,
+		Teams:     make([]Team, lobby.Settings.TeamCount),
+		Region:    lobby.Settings.Region,
+		Server:    serverInfo,
+		CreatedAt: time.Now(),
+	}
+	for _, m := range lobby.Members {
+		match.Players = append(match.Players, m.PlayerID)
+		match.Teams[m.Team].Players = append(match.Teams[m.Team].Players, m.PlayerID)
+	}
+
+	matchJSON, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, "match:"+match.MatchID, matchJSON, 24*time.Hour)
+	pipe.Set(ctx, gameMatchKey(serverInfo.GameID), match.MatchID, 24*time.Hour)
+	_, err = pipe.Exec(ctx)
+	return err
+}
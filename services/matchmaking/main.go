@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,58 +26,227 @@ import (
 var (
 	rdb             *redis.Client
 	orchestratorURL string
+	config          *Config
 
-	// Metrics
-	queueTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+	// Metrics, labelled by queue
+	queueTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "matchmaking_queue_time_seconds",
 		Help:    "Time spent in queue by players",
 		Buckets: prometheus.DefBuckets,
-	})
-	queueSize = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"queue"})
+	queueSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "matchmaking_queue_size",
 		Help: "Current number of players in queue",
-	})
-	matchesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"queue"})
+	matchesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "matchmaking_matches_created_total",
 		Help: "Total number of matches created",
-	})
-	ticketsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"queue"})
+	ticketsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "matchmaking_tickets_created_total",
 		Help: "Total number of matchmaking tickets created",
-	})
-	ticketsMatched = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"queue"})
+	ticketsMatched = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "matchmaking_tickets_matched_total",
 		Help: "Total number of tickets matched",
-	})
-	allocationLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+	}, []string{"queue"})
+	allocationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "orchestrator_allocation_latency_seconds",
 		Help:    "Time taken to allocate a game server",
 		Buckets: prometheus.DefBuckets,
-	})
-	allocationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"queue"})
+	allocationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "orchestrator_allocation_failures_total",
 		Help: "Total number of game server allocation failures",
+	}, []string{"queue"})
+	matchRatingSpread = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_match_rating_spread",
+		Help:    "Difference between the highest and lowest rated player in a match",
+		Buckets: prometheus.LinearBuckets(0, 50, 12),
+	}, []string{"queue"})
+	matchSearchWindow = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_match_search_window",
+		Help:    "Rating search window that admitted a match when it was formed",
+		Buckets: prometheus.LinearBuckets(0, 100, 12),
+	}, []string{"queue"})
+	matchTeamRatingGap = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_match_team_rating_gap",
+		Help:    "Difference between the average ratings of the strongest and weakest team in a match",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"queue"})
+	matchFavouriteWinProbability = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_match_favourite_win_probability",
+		Help:    "Predicted win probability of the strongest team in a match",
+		Buckets: prometheus.LinearBuckets(0, 0.1, 11),
+	}, []string{"queue"})
+	matchesByRegion = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_matches_by_region_total",
+		Help: "Total number of matches created per server region",
+	}, []string{"queue", "region"})
+	matchMaxPing = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_match_max_ping_ms",
+		Help:    "Highest ping of any player to the region the match was placed in",
+		Buckets: []float64{20, 40, 60, 80, 100, 125, 150, 200, 250, 300},
+	}, []string{"queue"})
+	partySize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_ticket_party_size",
+		Help:    "Number of players queueing together on a ticket",
+		Buckets: prometheus.LinearBuckets(1, 1, 5),
+	}, []string{"queue"})
+	ticketsRequeued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_tickets_requeued_total",
+		Help: "Total number of tickets put back into the queue after a failed server allocation",
+	}, []string{"queue"})
+	ticketsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_tickets_failed_total",
+		Help: "Total number of tickets that failed after exhausting their allocation attempts",
+	}, []string{"queue"})
+	leaseOwned = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "matchmaking_queue_lease_owned",
+		Help: "Whether this instance currently owns the worker lease of a queue (1) or not (0)",
+	}, []string{"queue", "instance"})
+	leaseChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_queue_lease_changes_total",
+		Help: "Total number of queue leases acquired or lost by this instance",
+	}, []string{"queue", "event"})
+	readyChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_ready_checks_total",
+		Help: "Total number of ready checks by outcome (accepted, declined, timeout)",
+	}, []string{"queue", "outcome"})
+	penaltyOffences = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_penalty_offences_total",
+		Help: "Total number of offences recorded by kind (decline, dodge, leave)",
+	}, []string{"queue", "kind"})
+	penaltiesApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_penalties_applied_total",
+		Help: "Total number of penalties applied by action (warning, lockout, lowPriority)",
+	}, []string{"queue", "action"})
+	penalisedJoins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_penalised_joins_total",
+		Help: "Total number of players joining with an active penalty, by action; lockouts are rejected",
+	}, []string{"queue", "action"})
+	readyCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_ready_check_duration_seconds",
+		Help:    "Time from opening a ready check until it was resolved",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 7.5, 10, 15, 20, 30},
+	}, []string{"queue"})
+	statusStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "matchmaking_status_streams",
+		Help: "Number of open ticket status streams",
 	})
+	statusEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "matchmaking_status_events_total",
+		Help: "Total number of ticket status events pushed to streams",
+	})
+	roleQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "matchmaking_role_queue_depth",
+		Help: "Number of players at the head of a role queue offering each role, fill counted separately",
+	}, []string{"queue", "role"})
+	roleOldestWait = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "matchmaking_role_oldest_wait_seconds",
+		Help: "Longest current wait among the players at the head of a role queue offering each role",
+	}, []string{"queue", "role"})
+	roleQueueTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_role_queue_time_seconds",
+		Help:    "Time spent in queue by matched players per role they got, fill for players placed outside their roles",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"queue", "role"})
+	matchResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_match_results_total",
+		Help: "Total number of match results recorded",
+	}, []string{"queue"})
+	ratingChange = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_rating_change",
+		Help:    "Absolute rating change of a player from a single result; shrinks as ratings converge",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+	}, []string{"queue", "algorithm"})
+	ratingUncertainty = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_rating_uncertainty",
+		Help:    "Rating uncertainty of a player after a result",
+		Buckets: prometheus.LinearBuckets(25, 25, 14),
+	}, []string{"queue", "algorithm"})
+	ratingPredictionBrier = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_rating_prediction_brier",
+		Help:    "Brier score of the win probabilities predicted when a match was made, against its result (0 is perfect)",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"queue", "algorithm"})
+	waitEstimateError = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_wait_estimate_error_seconds",
+		Help:    "Actual queue time minus the estimate given on join; negative when matched sooner",
+		Buckets: []float64{-60, -30, -15, -5, -1, 1, 5, 15, 30, 60},
+	}, []string{"queue"})
+	waitEstimates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_wait_estimates_total",
+		Help: "Total number of matched tickets by how their queue time compared to the estimated range (within, shorter, longer, none)",
+	}, []string{"queue", "result"})
+	ticketsReaped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_tickets_reaped_total",
+		Help: "Total number of tickets removed from the queue by the sweeper, by reason (expired, abandoned)",
+	}, []string{"queue", "reason"})
+	backfillRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_backfill_requests_total",
+		Help: "Total number of backfills opened by game servers that lost players",
+	}, []string{"queue"})
+	lobbiesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_lobbies_created_total",
+		Help: "Total number of private lobbies created",
+	}, []string{"mode"})
+	lobbyStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_lobby_starts_total",
+		Help: "Total number of lobby starts by result (started, failed)",
+	}, []string{"mode", "result"})
+	botFilledMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_bot_filled_matches_total",
+		Help: "Total number of matches created with bots in empty slots; also counted in matchmaking_matches_created_total",
+	}, []string{"queue"})
+	botsAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_bots_total",
+		Help: "Total number of bots placed into matches",
+	}, []string{"queue"})
+	backfilledPlayers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchmaking_backfilled_players_total",
+		Help: "Total number of players placed into running games",
+	}, []string{"queue"})
+	backfillFillTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchmaking_backfill_fill_seconds",
+		Help:    "Time from opening a backfill until players were placed into it",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"queue"})
 )
 
 func init() {
-	prometheus.MustRegister(queueTime, queueSize, matchesCreated, ticketsCreated, ticketsMatched, allocationLatency, allocationFailures)
+	prometheus.MustRegister(queueTime, queueSize, matchesCreated, ticketsCreated, ticketsMatched, allocationLatency, allocationFailures, matchRatingSpread, matchSearchWindow, matchTeamRatingGap, matchFavouriteWinProbability, matchesByRegion, matchMaxPing, partySize, ticketsRequeued, ticketsFailed, leaseOwned, leaseChanges, readyChecks, readyCheckDuration, penaltyOffences, penaltiesApplied, penalisedJoins, statusStreams, statusEvents, roleQueueDepth, roleOldestWait, roleQueueTime, matchResults, ratingChange, ratingUncertainty, ratingPredictionBrier, waitEstimateError, waitEstimates, ticketsReaped, backfillRequests, backfilledPlayers, backfillFillTime, botFilledMatches, botsAdded, lobbiesCreated, lobbyStarts)
 }
 
 const (
 	ticketTTL = 10 * time.Minute
-	queueKey  = "queue:default"
+	// scanDepth limits how many queued tickets the worker inspects per pass.
+	scanDepth = 500
 )
 
 // Data Structures
 
 type JoinRequest struct {
-	PlayerID string `json:"id"`
+	PlayerID string   `json:"id"`
+	Party    []string `json:"party,omitempty"` // other members queueing with the player
+	Queue    string   `json:"queue,omitempty"` // defaults to the configured default queue
+	// Measured round trip in milliseconds per region, shared by the party
+	Pings map[string]int `json:"pings,omitempty"`
+	// Preferred roles in role queues; "fill" takes any role. Roles of party
+	// members are given per member ID.
+	Roles      []string            `json:"roles,omitempty"`
+	PartyRoles map[string][]string `json:"partyRoles,omitempty"`
 }
 
 type JoinResponse struct {
 	TicketID string `json:"ticketId"`
 	Status   string `json:"status"`
+	// Warnings and low priority of party members; low priority tickets are not
+	// matched before DelayedUntil
+	Penalties    []PlayerPenalty `json:"penalties,omitempty"`
+	DelayedUntil time.Time       `json:"delayedUntil,omitzero"`
+	// Left out while there are too few recent matches to estimate from
+	EstimatedWait *WaitEstimate `json:"estimatedWait,omitempty"`
 }
 
 type ServerInfo struct {
@@ -80,28 +256,104 @@ type ServerInfo struct {
 	GameID string `json:"gameId,omitempty"`
 }
 
+type TicketPlayer struct {
+	PlayerID    string   `json:"playerId"`
+	Rating      float64  `json:"rating"`
+	Uncertainty float64  `json:"uncertainty"`
+	Roles       []string `json:"roles,omitempty"` // preferred roles in role queues
+}
+
 type Ticket struct {
-	PlayerID  string     `json:"playerId"`
-	Status    string     `json:"status"` // "searching", "matched", "cancelled"
-	CreatedAt time.Time  `json:"createdAt"`
-	MatchID   string     `json:"matchId,omitempty"`
-	Server    ServerInfo `json:"server,omitempty"`
+	PlayerID    string         `json:"playerId"` // player who queued, the party leader for party tickets
+	Queue       string         `json:"queue"`
+	Players     []TicketPlayer `json:"players"` // every player on the ticket, leader first
+	Status      string         `json:"status"`  // see the Status constants in state.go
+	CreatedAt   time.Time      `json:"createdAt"`
+	Rating      float64        `json:"rating"`          // average rating of Players
+	Uncertainty float64        `json:"uncertainty"`     // average uncertainty of Players
+	Pings       map[string]int `json:"pings,omitempty"` // round trip in ms per region; none means any region
+	MatchID     string         `json:"matchId,omitempty"`
+	Team        int            `json:"team"`
+	Server      ServerInfo     `json:"server,omitempty"`
+	// Set when the ticket filled a seat in a running match
+	Backfill bool `json:"backfill,omitempty"`
+	// Set on the stand-in tickets of bots, which never exist in Redis
+	Bot bool `json:"-"`
+
+	// Queue time credited for filling in role queues, see queuedSince
+	WaitBonus Duration `json:"waitBonus,omitempty"`
+
+	// Estimate given on join, compared with the actual queue time once matched
+	WaitEstimate *WaitEstimate `json:"waitEstimate,omitempty"`
+
+	// Set while the players are asked to accept the match in MatchID
+	AcceptDeadline time.Time `json:"acceptDeadline,omitzero"`
+
+	// Set when a party member is in low priority; the ticket sits out until RetryAt
+	LowPriority bool `json:"lowPriority,omitempty"`
+
+	// Set when server allocation for a match holding this ticket failed
+	AllocationAttempts int       `json:"allocationAttempts,omitempty"`
+	RetryAt            time.Time `json:"retryAt,omitzero"`
+	FailureReason      string    `json:"failureReason,omitempty"`
+}
+
+// Size returns the number of match slots the ticket occupies.
+func (t Ticket) Size() int {
+	return len(t.Players)
+}
+
+// queuedSince returns when the ticket counts as queued for matching: its
+// creation, moved earlier by any credited queue time.
+func (t Ticket) queuedSince() time.Time {
+	return t.CreatedAt.Add(-time.Duration(t.WaitBonus))
 }
 
 type Match struct {
 	MatchID   string     `json:"matchId"`
+	Queue     string     `json:"queue"`
 	Players   []string   `json:"players"`
+	Teams     []Team     `json:"teams"`
+	Region    string     `json:"region,omitempty"`
 	Server    ServerInfo `json:"server"`
 	CreatedAt time.Time  `json:"createdAt"`
+	// Bots in the teams, which are not in Players
+	Bots []TicketPlayer `json:"bots,omitempty"`
+	// Invite code of the lobby a private match was started from; empty for
+	// queued matches
+	Lobby string `json:"lobby,omitempty"`
 }
 
 // Orchestrator Types
+
+// GamePlayer is a player of a game and their team, the roster handed to the
+// game server.
+type GamePlayer struct {
+	ID   string `json:"id"`
+	Team int    `json:"team"`
+}
+
+// GameBot is a bot the game server simulates on a team, from its rating.
+type GameBot struct {
+	ID    string  `json:"id"`
+	Team  int     `json:"team"`
+	Skill float64 `json:"skill"`
+}
+
 type CreateGameResponse struct {
 	GameID    string `json:"game_id"`
 	ServerURL string `json:"server_url"`
 }
 
 func main() {
+	// "matchmaking replay" evaluates match functions offline, see runReplay
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
 	// Configuration
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
@@ -111,26 +363,93 @@ func main() {
 	if orchestratorURL == "" {
 		orchestratorURL = "http://game-orchestrator:8080"
 	}
+	configPath := os.Getenv("QUEUE_CONFIG")
+	if configPath == "" {
+		configPath = "queues.json"
+	}
+	var err error
+	config, err = loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Error loading queue config: %v", err)
+	}
+	ratingAlgorithm, err = newRatingAlgorithm(&config.Ratings)
+	if err != nil {
+		log.Fatalf("Error in rating config: %v", err)
+	}
+	if path := os.Getenv("TICKET_RECORDING"); path != "" {
+		if ticketRecorder, err = openRecorder(path); err != nil {
+			log.Fatalf("Error opening ticket recording: %v", err)
+		}
+	}
+
+	// Identifies this replica in queue leases and metrics
+	instanceID := os.Getenv("INSTANCE_ID")
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
 
 	// Initialize Redis
 	rdb = redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 	})
 
-	// Start Background Worker
-	go matchmakerWorker()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start one background worker per queue. Replicas compete for a lease per
+	// queue, so every queue is worked by exactly one replica at a time.
+	var wg sync.WaitGroup
+	for _, q := range config.Queues {
+		lease := newQueueLease(q, instanceID, time.Duration(config.WorkerLease.TTL))
+		leaseOwned.WithLabelValues(q.Name, instanceID).Set(0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lease.run(ctx)
+		}()
+		go matchmakerWorker(ctx, q, lease)
+	}
 
 	// Setup Routes
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/matchmaking/join", handleJoin)
 	http.HandleFunc("/matchmaking/status", handleStatus)
+	http.HandleFunc("/matchmaking/stream", handleStream)
+	http.HandleFunc("/matchmaking/accept", handleAccept)
+	http.HandleFunc("/matchmaking/rating", handleRating)
+	http.HandleFunc("/matchmaking/lobby", handleLobby)
+	http.HandleFunc("/matchmaking/lobby/create", handleLobbyCreate)
+	http.HandleFunc("/matchmaking/lobby/join", handleLobbyJoin)
+	http.HandleFunc("/matchmaking/lobby/team", handleLobbyTeam)
+	http.HandleFunc("/matchmaking/lobby/ready", handleLobbyReady)
+	http.HandleFunc("/matchmaking/lobby/leave", handleLobbyLeave)
+	http.HandleFunc("/matchmaking/lobby/start", handleLobbyStart)
+	// Not under /matchmaking/, so the gateway does not expose them to players
+	http.HandleFunc("/internal/report", handleReport)
+	http.HandleFunc("/internal/result", handleResult)
+	http.HandleFunc("/internal/backfill", handleBackfill)
 	http.HandleFunc("/matchmaking/cancel", handleCancel) // Basic robustness
 
 	port := "8081"
-	log.Printf("Matchmaking service listening on :%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Matchmaking service %s listening on :%s", instanceID, port)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+
+	// Hand the queues over to other replicas right away instead of waiting for the leases to expire
+	wg.Wait()
+}
+
+func playerTicketKey(playerID string) string {
+	return "player:" + playerID + ":ticket"
 }
 
 // Handlers
@@ -152,11 +471,115 @@ func handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	q, ok := config.Queue(req.Queue)
+	if !ok {
+		http.Error(w, "unknown queue", http.StatusBadRequest)
+		return
+	}
+
+	playerIDs := append([]string{req.PlayerID}, req.Party...)
+	if len(playerIDs) > q.TeamSize {
+		http.Error(w, fmt.Sprintf("party size is limited to %d in queue %s", q.TeamSize, q.Name), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(playerIDs))
+	for _, id := range playerIDs {
+		if id == "" || seen[id] {
+			http.Error(w, "party members must be unique and non-empty", http.StatusBadRequest)
+			return
+		}
+		if isBot(id) {
+			http.Error(w, fmt.Sprintf("player IDs starting with %q are reserved for bots", botPrefix), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+	roles := make(map[string][]string, len(playerIDs))
+	if q.Roles != nil {
+		for id := range req.PartyRoles {
+			if !seen[id] || id == req.PlayerID {
+				http.Error(w, fmt.Sprintf("partyRoles has roles for %q, who is not a party member", id), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, id := range playerIDs {
+			requested := req.PartyRoles[id]
+			if id == req.PlayerID {
+				requested = req.Roles
+			}
+			valid, err := q.Roles.validateRoles(requested)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("player %s: %v", id, err), http.StatusBadRequest)
+				return
+			}
+			roles[id] = valid
+		}
+	}
+	for region, ping := range req.Pings {
+		if !slices.Contains(config.Regions, region) {
+			http.Error(w, fmt.Sprintf("unknown region %q", region), http.StatusBadRequest)
+			return
+		}
+		if ping < 0 {
+			http.Error(w, "pings must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+
+	penalties, delay, err := penaltyStanding(ctx, playerIDs)
+	if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	lockedOut := false
+	for _, p := range penalties {
+		penalisedJoins.WithLabelValues(q.Name, p.Action).Inc()
+		lockedOut = lockedOut || p.Action == actionLockout
+	}
+	if lockedOut {
+		writeLockout(w, penalties)
+		return
+	}
+
 	ticketID := uuid.New().String()
 	ticket := Ticket{
 		PlayerID:  req.PlayerID,
-		Status:    "searching",
+		Queue:     q.Name,
+		Players:   make([]TicketPlayer, 0, len(playerIDs)),
+		Status:    StatusSearching,
 		CreatedAt: time.Now(),
+		Pings:     req.Pings,
+	}
+	if delay > 0 {
+		// The whole party waits out the longest delay among its members
+		ticket.LowPriority = true
+		ticket.RetryAt = ticket.CreatedAt.Add(delay)
+	}
+	for _, id := range playerIDs {
+		rating, err := loadRating(ctx, id)
+		if err != nil {
+			log.Printf("Redis error: %v", err)
+			http.Error(w, "Failed to load rating", http.StatusInternalServerError)
+			return
+		}
+		ticket.Players = append(ticket.Players, TicketPlayer{
+			PlayerID:    id,
+			Rating:      rating.Rating,
+			Uncertainty: rating.Uncertainty,
+			Roles:       roles[id],
+		})
+		ticket.Rating += rating.Rating / float64(len(playerIDs))
+		ticket.Uncertainty += rating.Uncertainty / float64(len(playerIDs))
+	}
+	if q.Roles != nil {
+		ticket.WaitBonus = Duration(q.Roles.fillBonus(ticket.Players))
+	}
+	// An estimate is a courtesy; joining does not depend on it
+	if ticket.WaitEstimate, err = estimateWait(ctx, q, ticket, 0); err != nil {
+		log.Printf("Estimating wait for queue %s failed: %v", q.Name, err)
 	}
 
 	ticketJSON, err := json.Marshal(ticket)
@@ -165,14 +588,18 @@ func handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := r.Context()
-
 	// Store ticket and add to queue
 	// Using a pipeline to ensure efficiency, though strict atomicity between Key Set and List Push isn't critical here
 	// as long as both happen.
 	pipe := rdb.Pipeline()
 	pipe.Set(ctx, "ticket:"+ticketID, ticketJSON, ticketTTL)
-	pipe.RPush(ctx, queueKey, ticketID)
+	for _, id := range playerIDs {
+		// Lets party members look up the shared ticket by their own ID
+		pipe.Set(ctx, playerTicketKey(id), ticketID, ticketTTL)
+	}
+	// The client keeps the heartbeat alive by polling or streaming the status
+	pipe.Set(ctx, heartbeatKey(ticketID), 1, time.Duration(config.Tickets.HeartbeatTimeout))
+	pipe.RPush(ctx, q.Key(), ticketID)
 	_, err = pipe.Exec(ctx)
 
 	if err != nil {
@@ -181,14 +608,22 @@ func handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ticketsCreated.Inc()
-	if size, err := rdb.LLen(ctx, queueKey).Result(); err == nil {
-		queueSize.Set(float64(size))
+	if err := ticketRecorder.record(ticketID, ticket); err != nil {
+		log.Printf("Recording ticket %s failed: %v", ticketID, err)
+	}
+
+	ticketsCreated.WithLabelValues(q.Name).Inc()
+	partySize.WithLabelValues(q.Name).Observe(float64(len(playerIDs)))
+	if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+		queueSize.WithLabelValues(q.Name).Set(float64(size))
 	}
 
 	resp := JoinResponse{
-		TicketID: ticketID,
-		Status:   "searching",
+		TicketID:      ticketID,
+		Status:        StatusSearching,
+		Penalties:     penalties,
+		DelayedUntil:  ticket.RetryAt,
+		EstimatedWait: ticket.WaitEstimate,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -201,40 +636,113 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ticketID := r.URL.Query().Get("ticketId")
-	if ticketID == "" {
-		http.Error(w, "ticketId required", http.StatusBadRequest)
+	ticketID, ok := requestedTicketID(w, r)
+	if !ok {
 		return
 	}
 
-	ctx := r.Context()
-	val, err := rdb.Get(ctx, "ticket:"+ticketID).Result()
+	response, err := ticketStatus(r.Context(), ticketID)
 	if err == redis.Nil {
 		http.Error(w, "Ticket not found", http.StatusNotFound)
 		return
+	} else if errors.Is(err, errCorruptTicket) {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
 	} else if err != nil {
 		log.Printf("Redis error: %v", err)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	if err := touchTicket(r.Context(), ticketID); err != nil && err != redis.Nil {
+		log.Printf("Heartbeat for ticket %s failed: %v", ticketID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// requestedTicketID returns the ticket named by the ticketId or playerId query
+// parameter. On failure it writes the error response and returns false.
+func requestedTicketID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// Party members may not know the shared ticket ID, so allow looking it up by player
+	ticketID := r.URL.Query().Get("ticketId")
+	if playerID := r.URL.Query().Get("playerId"); ticketID == "" && playerID != "" {
+		id, err := rdb.Get(r.Context(), playerTicketKey(playerID)).Result()
+		if err == redis.Nil {
+			http.Error(w, "Ticket not found", http.StatusNotFound)
+			return "", false
+		} else if err != nil {
+			log.Printf("Redis error: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return "", false
+		}
+		ticketID = id
+	}
+	if ticketID == "" {
+		http.Error(w, "ticketId or playerId required", http.StatusBadRequest)
+		return "", false
+	}
+	return ticketID, true
+}
+
+var errCorruptTicket = errors.New("corrupt ticket")
+
+// ticketStatus builds the status response of a ticket. It returns redis.Nil if
+// the ticket does not exist.
+func ticketStatus(ctx context.Context, ticketID string) (map[string]interface{}, error) {
+	val, err := rdb.Get(ctx, "ticket:"+ticketID).Result()
+	if err != nil {
+		return nil, err
+	}
 
 	var ticket Ticket
 	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
-		http.Error(w, "Data corruption", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("%w %s: %v", errCorruptTicket, ticketID, err)
 	}
 
 	response := map[string]interface{}{
-		"status": ticket.Status,
+		"ticketId": ticketID,
+		"queue":    ticket.Queue,
+		"status":   ticket.Status,
+	}
+	if ticket.LowPriority {
+		response["lowPriority"] = true
+	}
+
+	if ticket.Status == StatusSearching {
+		q, ok := config.Queue(ticket.Queue)
+		if ok {
+			estimate, err := estimateWait(ctx, q, ticket, time.Since(ticket.CreatedAt))
+			if err != nil {
+				log.Printf("Estimating wait for ticket %s failed: %v", ticketID, err)
+			} else if estimate != nil {
+				response["estimatedWait"] = estimate
+			}
+		}
 	}
 
-	if ticket.Status == "matched" {
+	if ticket.Status == StatusMatched {
 		response["matchId"] = ticket.MatchID
 		response["server"] = ticket.Server
-	}
+		response["team"] = ticket.Team
+		if ticket.Backfill {
+			response["backfill"] = true
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+		if val, err := rdb.Get(ctx, "match:"+ticket.MatchID).Result(); err == nil {
+			var match Match
+			if json.Unmarshal([]byte(val), &match) == nil {
+				response["teams"] = match.Teams
+				response["region"] = match.Region
+			}
+		}
+	} else if ticket.Status == StatusPendingAccept {
+		response["matchId"] = ticket.MatchID
+		response["acceptDeadline"] = ticket.AcceptDeadline
+	} else if ticket.Status == StatusFailed || ticket.Status == StatusDeclined || ticket.Status == StatusAbandoned {
+		response["reason"] = ticket.FailureReason
+	}
+	return response, nil
 }
 
 func handleCancel(w http.ResponseWriter, r *http.Request) {
@@ -263,8 +771,8 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
-	// Update ticket status to cancelled
-	// First get current ticket to check status
+	// The queue is fixed for the lifetime of a ticket, so reading it up front is safe.
+	// The status check and queue removal happen atomically in the transition.
 	val, err := rdb.Get(ctx, "ticket:"+ticketID).Result()
 	if err == redis.Nil {
 		http.NotFound(w, r)
@@ -275,18 +783,33 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var ticket Ticket
-	json.Unmarshal([]byte(val), &ticket)
-
-	if ticket.Status == "searching" {
-		ticket.Status = "cancelled"
-		updatedJSON, _ := json.Marshal(ticket)
+	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	}
+	q, _ := config.Queue(ticket.Queue)
 
-		// Remove from queue
-		rdb.LRem(ctx, queueKey, 0, ticketID)
-		rdb.Set(ctx, "ticket:"+ticketID, updatedJSON, ticketTTL)
+	prev, err := transitionTicket(ctx, ticketID, q, StatusSearching, StatusCancelled, nil, queueRemove)
+	if err == redis.Nil {
+		http.NotFound(w, r)
+		return
+	} else if errors.Is(err, ErrTransition) {
+		switch prev {
+		case StatusCancelled, StatusFailed, StatusDeclined, StatusAbandoned:
+			// Nothing left to cancel
+		default:
+			http.Error(w, fmt.Sprintf("ticket is %s and can no longer be cancelled", prev), http.StatusConflict)
+			return
+		}
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 
-		if size, err := rdb.LLen(ctx, queueKey).Result(); err == nil {
-			queueSize.Set(float64(size))
+	if q != nil {
+		if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+			queueSize.WithLabelValues(q.Name).Set(float64(size))
 		}
 	}
 
@@ -295,96 +818,303 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 
 // Worker
 
-func matchmakerWorker() {
-	log.Println("Matchmaking worker started")
-	ctx := context.Background()
-
-	// Lua script to atomically pop 10 items if length >= 10
-	popScript := redis.NewScript(`
-		if redis.call("LLEN", KEYS[1]) >= 10 then
-			return redis.call("LPOP", KEYS[1], 10)
-		else
-			return nil
-		end
-	`)
-
-	for {
-		// Run Lua script
-		result, err := popScript.Run(ctx, rdb, []string{queueKey}).Result()
-		if err != nil && err != redis.Nil {
+// maxClaimRounds limits how often a worker tries to backfill a group that lost
+// tickets between reading the queue and claiming them.
+const maxClaimRounds = 3
+
+func matchmakerWorker(ctx context.Context, q *QueueConfig, lease *queueLease) {
+	matcher := matchFunctionFor(q, config.Regions)
+	log.Printf("Matchmaking worker for queue %s started (match function %s)", q.Name, matcher.Name())
+
+	var lastSweep time.Time
+	for ctx.Err() == nil {
+		if !lease.Held() {
+			// Another replica owns this queue
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		if time.Since(lastSweep) >= time.Duration(config.Tickets.SweepInterval) {
+			if err := sweepQueue(ctx, q); err != nil {
+				log.Printf("Worker redis error: %v", err)
+			}
+			lastSweep = time.Now()
+		}
+
+		if err := resolveReadyChecks(ctx, q, lease); err != nil {
+			log.Printf("Worker redis error: %v", err)
+		}
+
+		tickets, err := loadQueuedTickets(ctx, q)
+		if err != nil {
 			log.Printf("Worker redis error: %v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
+		if q.Roles != nil {
+			recordRoleQueue(q, tickets, time.Now())
+		}
 
-		if err == redis.Nil || result == nil {
-			// Not enough players
-			time.Sleep(500 * time.Millisecond)
-			continue
+		// Running games that lost players are served first
+		if rest, err := fillBackfills(ctx, q, tickets); err != nil {
+			log.Printf("Worker redis error: %v", err)
+		} else {
+			tickets = rest
 		}
 
-		// Parse result
-		vals, ok := result.([]interface{})
-		if !ok {
-			log.Printf("Worker unexpected result type")
+		proposals := matcher.Propose(tickets, time.Now())
+		if p := proposeWithBots(q, tickets, proposals, config.Regions, time.Now()); p != nil {
+			proposals = append(proposals, *p)
+		}
+		if len(proposals) == 0 {
+			// Not enough players (within the rating and ping windows)
+			time.Sleep(500 * time.Millisecond)
 			continue
 		}
 
-		ticketIDs := make([]string, 0, len(vals))
-		for _, v := range vals {
-			if s, ok := v.(string); ok {
-				ticketIDs = append(ticketIDs, s)
+		for _, p := range proposals {
+			// Matching may take a while; another replica may own the queue by now
+			if !lease.Held() {
+				break
+			}
+			if err := startMatch(ctx, q, p, tickets); err != nil {
+				log.Printf("Worker redis error: %v", err)
+				time.Sleep(1 * time.Second)
+				break
 			}
 		}
+	}
+}
 
-		if len(ticketIDs) > 0 {
-			if size, err := rdb.LLen(ctx, queueKey).Result(); err == nil {
-				queueSize.Set(float64(size))
-			}
+// startMatch claims the tickets of a proposal and asks their players to
+// accept the match. Proposals whose tickets are gone and cannot be backfilled
+// from the snapshot, or replaced by bots, are dropped.
+func startMatch(ctx context.Context, q *QueueConfig, p Proposal, snapshot []queuedTicket) error {
+	var group []queuedTicket
+	var bots []TicketPlayer
+	var err error
+	if p.Bots != nil {
+		group, bots, err = claimWithBots(ctx, q, p)
+	} else {
+		group, err = claimGroup(ctx, q, p.Region, p.Tickets, snapshot)
+	}
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		// Queue changed underneath us, the next scan picks up what is left
+		return nil
+	}
+
+	if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+		queueSize.WithLabelValues(q.Name).Set(float64(size))
+	}
+
+	var window float64
+	if q.SearchWindow != nil {
+		window = groupWindow(group, *q.SearchWindow, time.Now())
+	}
+	region := p.Region
+	if q.PingWindow == nil {
+		// Backfilled tickets may have moved the best region
+		region = closestRegion(group, config.Regions)
+	}
+
+	log.Printf("[%s] Found %d tickets and %d bots in %s (rating spread %.0f, window %.0f), asking players to accept...", q.Name, len(group), len(bots), region, ratingSpread(group), window)
+	if err := openReadyCheck(ctx, q, region, group, bots, window); err != nil {
+		log.Printf("Failed to open ready check: %v", err)
+		if err := releaseTickets(ctx, q, StatusMatching, group, nil); err != nil {
+			log.Printf("Failed to release tickets: %v", err)
+		}
+	}
+	return nil
+}
 
-			log.Printf("Found %d players, creating match...", len(ticketIDs))
-			if err := createMatch(ctx, ticketIDs); err != nil {
-				log.Printf("Failed to create match: %v", err)
-				// Robustness: Could push tickets back to queue here
-				// For now, logging error.
+// claimGroup claims the proposed group for this worker. Tickets that were
+// cancelled or taken by another worker since the snapshot are dropped and the
+// freed slots are backfilled from the rest of the snapshot that may play in the
+// region. If the group cannot be completed, the claimed tickets go back to the
+// front of the queue and nil is returned.
+func claimGroup(ctx context.Context, q *QueueConfig, region string, group, snapshot []queuedTicket) ([]queuedTicket, error) {
+	tried := make(map[string]bool)
+	var claimed []queuedTicket
+
+	pending := group
+	for round := 0; round < maxClaimRounds && len(pending) > 0; round++ {
+		got, err := claimTickets(ctx, q, pending)
+		if err != nil {
+			return nil, errors.Join(err, releaseTickets(ctx, q, StatusMatching, claimed, nil))
+		}
+		claimed = append(claimed, got...)
+		for _, t := range pending {
+			tried[t.ID] = true
+		}
+
+		if slotsUsed(claimed) == q.MatchSize() {
+			return claimed, nil
+		}
+
+		now := time.Now()
+		var candidates []queuedTicket
+		for _, t := range snapshot {
+			if tried[t.ID] {
+				continue
+			}
+			if q.PingWindow != nil && !acceptablePing(t, region, *q.PingWindow, now) {
+				continue
 			}
+			candidates = append(candidates, t)
+		}
+		pending = backfillGroup(claimed, candidates, q, now)
+	}
+
+	return nil, releaseTickets(ctx, q, StatusMatching, claimed, nil)
+}
+
+// loadQueuedTickets reads the head of the queue together with the ticket data.
+// Tickets whose key has already expired or that lost their heartbeat are skipped.
+func loadQueuedTickets(ctx context.Context, q *QueueConfig) ([]queuedTicket, error) {
+	ids, err := rdb.LRange(ctx, q.Key(), 0, scanDepth-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := loadTickets(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Tickets whose client went away wait for the sweeper instead of being matched
+	tickets, err = aliveTickets(ctx, tickets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tickets backing off after a failed allocation sit out until they may retry
+	now := time.Now()
+	ready := tickets[:0]
+	for _, t := range tickets {
+		if t.RetryAt.After(now) {
+			continue
 		}
+		ready = append(ready, t)
 	}
+	return ready, nil
 }
 
-func createMatch(ctx context.Context, ticketIDs []string) error {
-	matchID := uuid.New().String()
+// loadTickets fetches the ticket data for the given IDs. Tickets whose key has
+// already expired are skipped.
+func loadTickets(ctx context.Context, ids []string) ([]queuedTicket, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "ticket:" + id
+	}
+	vals, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tickets := make([]queuedTicket, 0, len(ids))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var t Ticket
+		if err := json.Unmarshal([]byte(s), &t); err != nil {
+			continue
+		}
+		tickets = append(tickets, queuedTicket{ID: ids[i], Ticket: t})
+	}
+	return tickets, nil
+}
+
+// errMatchNotCommitted marks a match that got a server but could not be
+// stored. It does not count as a failed allocation.
+var errMatchNotCommitted = errors.New("match not committed")
+
+// abandonMatch releases the server of a match that could not be stored.
+func abandonMatch(serverInfo ServerInfo, cause error) error {
+	if err := releaseServer(serverInfo.GameID); err != nil {
+		log.Printf("Releasing game server of game %s failed: %v", serverInfo.GameID, err)
+	}
+	return fmt.Errorf("%w: %w", errMatchNotCommitted, cause)
+}
+
+func createMatch(ctx context.Context, q *QueueConfig, matchID, region string, group []queuedTicket, bots []TicketPlayer, window float64) error {
+	// Never start a game short of players, e.g. after a ticket expired during the ready check
+	if players := slotsUsed(group) + len(bots); players != q.MatchSize() {
+		return fmt.Errorf("match has %d of %d players", players, q.MatchSize())
+	}
+	missing, err := missingTickets(ctx, group)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("tickets %v no longer exist", missing)
+	}
+
+	balanced := balanceTeams(append(slices.Clip(group), botTickets(bots)...), q.TeamCount, q.TeamSize, q.Roles)
+	if balanced == nil {
+		return fmt.Errorf("cannot split %d tickets and %d bots into %d teams of %d", len(group), len(bots), q.TeamCount, q.TeamSize)
+	}
+	teams := buildTeams(balanced, q.Roles)
+
+	// The game server plays the bots itself
+	var gamePlayers []GamePlayer
+	var gameBots []GameBot
+	for team, members := range balanced {
+		for _, t := range members {
+			if t.Bot {
+				gameBots = append(gameBots, GameBot{ID: t.ID, Team: team, Skill: t.Rating})
+				continue
+			}
+			for _, p := range t.Players {
+				gamePlayers = append(gamePlayers, GamePlayer{ID: p.PlayerID, Team: team})
+			}
+		}
+	}
 
 	// Call Orchestrator to allocate server
 	start := time.Now()
-	serverInfo, err := allocateServer()
-	allocationLatency.Observe(time.Since(start).Seconds())
+	serverInfo, err := allocateServer(q.GameDuration, region, "", gamePlayers, gameBots)
+	allocationLatency.WithLabelValues(q.Name).Observe(time.Since(start).Seconds())
 	if err != nil {
-		allocationFailures.Inc()
+		allocationFailures.WithLabelValues(q.Name).Inc()
 		return fmt.Errorf("allocating server: %w", err)
 	}
 
-	matchesCreated.Inc()
-	ticketsMatched.Add(float64(len(ticketIDs)))
-
-	// Fetch player IDs from tickets to store in match object
-	var playerIDs []string
-	for _, tid := range ticketIDs {
-		val, err := rdb.Get(ctx, "ticket:"+tid).Result()
-		if err == nil {
-			var t Ticket
-			if json.Unmarshal([]byte(val), &t) == nil {
-				playerIDs = append(playerIDs, t.PlayerID)
-				queueTime.Observe(time.Since(t.CreatedAt).Seconds())
+	ticketIDs := make([]string, 0, len(group))
+	playerIDs := make([]string, 0, q.MatchSize())
+	patches := make([]map[string]interface{}, 0, len(group))
+	for team, members := range balanced {
+		for _, t := range members {
+			if t.Bot {
+				continue
 			}
+			ticketIDs = append(ticketIDs, t.ID)
+			for _, p := range t.Players {
+				playerIDs = append(playerIDs, p.PlayerID)
+			}
+			patches = append(patches, map[string]interface{}{
+				"matchId": matchID,
+				"team":    team,
+				"server":  serverInfo,
+			})
 		}
 	}
 
 	match := Match{
 		MatchID:   matchID,
+		Queue:     q.Name,
 		Players:   playerIDs,
+		Teams:     teams,
+		Region:    region,
 		Server:    serverInfo,
 		CreatedAt: time.Now(),
+		Bots:      bots,
 	}
 
 	matchJSON, err := json.Marshal(match)
@@ -392,44 +1122,69 @@ func createMatch(ctx context.Context, ticketIDs []string) error {
 		return err
 	}
 
-	// Store match
-	if err := rdb.Set(ctx, "match:"+matchID, matchJSON, 24*time.Hour).Err(); err != nil {
-		return fmt.Errorf("saving match: %w", err)
+	// Store match, and where to find it for reports from its game server
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, "match:"+matchID, matchJSON, 24*time.Hour)
+	pipe.Set(ctx, gameMatchKey(serverInfo.GameID), matchID, 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return abandonMatch(serverInfo, fmt.Errorf("saving match: %w", err))
 	}
 
-	// Update tickets
-	for _, tid := range ticketIDs {
-		// Read-Modify-Write for ticket
-		// Ideally use optimistic locking (WATCH) or Lua, but simple GET/SET is acceptable for this scope
-		// assuming single worker processing this specific ticket or acceptable race with cancel.
-
-		val, err := rdb.Get(ctx, "ticket:"+tid).Result()
-		if err != nil {
-			log.Printf("Failed to get ticket %s to update: %v", tid, err)
-			continue
-		}
+	// Update all tickets in one step, claimed tickets cannot be cancelled in between
+	if err := transitionTickets(ctx, ticketIDs, StatusMatching, StatusMatched, patches); err != nil {
+		rdb.Del(ctx, "match:"+matchID, gameMatchKey(serverInfo.GameID))
+		return abandonMatch(serverInfo, fmt.Errorf("committing tickets: %w", err))
+	}
 
-		var t Ticket
-		if err := json.Unmarshal([]byte(val), &t); err != nil {
-			continue
+	matchesCreated.WithLabelValues(q.Name).Inc()
+	if len(bots) > 0 {
+		botFilledMatches.WithLabelValues(q.Name).Inc()
+		botsAdded.WithLabelValues(q.Name).Add(float64(len(bots)))
+	}
+	ticketsMatched.WithLabelValues(q.Name).Add(float64(len(group)))
+	matchRatingSpread.WithLabelValues(q.Name).Observe(ratingSpread(group))
+	if q.SearchWindow != nil {
+		matchSearchWindow.WithLabelValues(q.Name).Observe(window)
+	}
+	matchTeamRatingGap.WithLabelValues(q.Name).Observe(teamRatingGap(teams))
+	matchFavouriteWinProbability.WithLabelValues(q.Name).Observe(favouriteWinProbability(teams))
+	matchesByRegion.WithLabelValues(q.Name, region).Inc()
+	if region != "" {
+		matchMaxPing.WithLabelValues(q.Name).Observe(maxPing(group, region))
+	}
+	for _, t := range group {
+		queueTime.WithLabelValues(q.Name).Observe(time.Since(t.CreatedAt).Seconds())
+	}
+	if err := recordWaits(ctx, q, group); err != nil {
+		log.Printf("[%s] Recording queue times failed: %v", q.Name, err)
+	}
+	if q.Roles != nil {
+		for team, members := range balanced {
+			for _, t := range members {
+				if t.Bot {
+					continue
+				}
+				for _, p := range t.Players {
+					role := roleWaitLabel(p, teams[team].Roles[p.PlayerID])
+					roleQueueTime.WithLabelValues(q.Name, role).Observe(time.Since(t.CreatedAt).Seconds())
+				}
+			}
 		}
-
-		t.Status = "matched"
-		t.MatchID = matchID
-		t.Server = serverInfo
-
-		updatedJSON, _ := json.Marshal(t)
-		rdb.Set(ctx, "ticket:"+tid, updatedJSON, ticketTTL)
 	}
 
-	log.Printf("Match %s created for tickets: %v", matchID, ticketIDs)
+	log.Printf("[%s] Match %s created for tickets: %v (%d bots)", q.Name, matchID, ticketIDs, len(bots))
 	return nil
 }
 
-func allocateServer() (ServerInfo, error) {
+func allocateServer(duration Duration, region, gameMap string, players []GamePlayer, bots []GameBot) (ServerInfo, error) {
 	// Request to orchestrator
-	reqBody, _ := json.Marshal(map[string]string{
-		"game_id": uuid.New().String(),
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"game_id":  uuid.New().String(),
+		"duration": duration.String(),
+		"region":   region,
+		"map":      gameMap,
+		"players":  players,
+		"bots":     bots,
 	})
 
 	resp, err := http.Post(orchestratorURL+"/create", "application/json", bytes.NewBuffer(reqBody))
@@ -439,7 +1194,9 @@ func allocateServer() (ServerInfo, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return ServerInfo{}, fmt.Errorf("orchestrator returned status %d", resp.StatusCode)
+		// The orchestrator explains why it could not provide a server
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return ServerInfo{}, fmt.Errorf("orchestrator returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(reason)))
 	}
 
 	var gameResp CreateGameResponse
@@ -456,3 +1213,22 @@ func allocateServer() (ServerInfo, error) {
 		// orchestratorURL usually looks like ws://hostname:8080/game/...
 	}, nil
 }
+
+// releaseServer stops a game server that was allocated for a game that did
+// not come about.
+func releaseServer(gameID string) error {
+	req, err := http.NewRequest(http.MethodDelete, orchestratorURL+"/games/"+gameID, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Conflict: the game ended already
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("orchestrator returned status %d", resp.StatusCode)
+	}
+	return nil
+}
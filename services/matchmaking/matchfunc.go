@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Match functions selectable per queue, see matchFunctionFor.
+const (
+	matchFIFO  = "fifo"
+	matchSkill = "skill"
+	matchRole  = "role"
+)
+
+// Proposal is a group of tickets a match function wants to match, and the
+// region to host the match in ("" if no ticket measured pings). Bot-filled
+// proposals carry the bots taking the remaining slots.
+type Proposal struct {
+	Tickets []queuedTicket
+	Region  string
+	Bots    []TicketPlayer
+}
+
+// MatchFunction turns a snapshot of waiting tickets into proposed matches,
+// like a match function (MMF) in Open Match. Proposals never share tickets.
+// The worker claims and confirms them; a match function only reads.
+type MatchFunction interface {
+	Name() string
+	Propose(tickets []queuedTicket, now time.Time) []Proposal
+}
+
+// fifoMatch fills matches in queue order and ignores ratings.
+type fifoMatch struct {
+	q       *QueueConfig
+	regions []string
+}
+
+func (fifoMatch) Name() string { return matchFIFO }
+
+func (m fifoMatch) Propose(tickets []queuedTicket, now time.Time) []Proposal {
+	return proposeMatches(tickets, m.q, m.regions, now, func(tickets []queuedTicket) []queuedTicket {
+		return findQueueOrderGroup(tickets, m.q.TeamCount, m.q.TeamSize, nil)
+	})
+}
+
+// skillMatch forms the tightest groups that fit the search window of their
+// members.
+type skillMatch struct {
+	q       *QueueConfig
+	regions []string
+}
+
+func (skillMatch) Name() string { return matchSkill }
+
+func (m skillMatch) Propose(tickets []queuedTicket, now time.Time) []Proposal {
+	return proposeMatches(tickets, m.q, m.regions, now, func(tickets []queuedTicket) []queuedTicket {
+		group, _ := findSkillGroup(tickets, m.q.TeamCount, m.q.TeamSize, nil, *m.q.SearchWindow, now)
+		return group
+	})
+}
+
+// roleMatch only forms groups whose teams fill the role composition, by
+// rating when the queue has a search window and in queue order otherwise.
+type roleMatch struct {
+	q       *QueueConfig
+	regions []string
+}
+
+func (roleMatch) Name() string { return matchRole }
+
+func (m roleMatch) Propose(tickets []queuedTicket, now time.Time) []Proposal {
+	return proposeMatches(tickets, m.q, m.regions, now, func(tickets []queuedTicket) []queuedTicket {
+		if m.q.SearchWindow != nil {
+			group, _ := findSkillGroup(tickets, m.q.TeamCount, m.q.TeamSize, m.q.Roles, *m.q.SearchWindow, now)
+			return group
+		}
+		return findQueueOrderGroup(tickets, m.q.TeamCount, m.q.TeamSize, m.q.Roles)
+	})
+}
+
+// matchFunctionFor returns the match function of a queue: role queues match
+// by role, queues with a search window by skill, and the rest in queue order.
+func matchFunctionFor(q *QueueConfig, regions []string) MatchFunction {
+	switch {
+	case q.Roles != nil:
+		return roleMatch{q: q, regions: regions}
+	case q.SearchWindow != nil:
+		return skillMatch{q: q, regions: regions}
+	default:
+		return fifoMatch{q: q, regions: regions}
+	}
+}
+
+// withMatchFunction returns a copy of the queue configured for the named match
+// function, so that the worker's backfill and team balancing follow it too.
+// Skill matching keeps the queue's search window, or uses defaultWindow.
+func withMatchFunction(q *QueueConfig, name string, defaultWindow WindowCurve) (*QueueConfig, error) {
+	c := *q
+	switch name {
+	case matchFIFO:
+		c.SearchWindow, c.Roles = nil, nil
+	case matchSkill:
+		c.Roles = nil
+		if c.SearchWindow == nil {
+			c.SearchWindow = &defaultWindow
+		}
+	case matchRole:
+		if c.Roles == nil {
+			return nil, fmt.Errorf("queue %q has no roles", q.Name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown match function %q", name)
+	}
+	return &c, nil
+}
+
+// proposeMatches repeatedly picks a group with find from the tickets not yet
+// proposed, until no further group can be formed.
+func proposeMatches(tickets []queuedTicket, q *QueueConfig, regions []string, now time.Time, find func([]queuedTicket) []queuedTicket) []Proposal {
+	var proposals []Proposal
+	remaining := tickets
+	for {
+		group, region := findGroup(remaining, q, regions, now, find)
+		if group == nil {
+			return proposals
+		}
+		proposals = append(proposals, Proposal{Tickets: group, Region: region})
+
+		taken := make(map[string]bool, len(group))
+		for _, t := range group {
+			taken[t.ID] = true
+		}
+		var rest []queuedTicket
+		for _, t := range remaining {
+			if !taken[t.ID] {
+				rest = append(rest, t)
+			}
+		}
+		remaining = rest
+	}
+}
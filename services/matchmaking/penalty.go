@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Offences counted towards a player's penalty record.
+const (
+	offenceDecline = "decline" // declined a ready check
+	offenceDodge   = "dodge"   // let a ready check time out
+	offenceLeave   = "leave"   // disconnected before the game ended, reported by the game server
+)
+
+// Penalty actions, from mildest to harshest.
+const (
+	actionWarning     = "warning"
+	actionLowPriority = "lowPriority"
+	actionLockout     = "lockout"
+)
+
+// PenaltyConfig controls how offences escalate. The number of offences within
+// the rolling window selects the step with the highest threshold reached.
+type PenaltyConfig struct {
+	Window Duration      `json:"window"`
+	Steps  []PenaltyStep `json:"steps"`
+}
+
+type PenaltyStep struct {
+	Offences int      `json:"offences"`
+	Action   string   `json:"action"`
+	Duration Duration `json:"duration,omitempty"` // how long a lockout or low priority lasts
+	Delay    Duration `json:"delay,omitempty"`    // low priority: how long tickets are held back before matching
+}
+
+func (c PenaltyConfig) validate() error {
+	if c.Window <= 0 {
+		return fmt.Errorf("penalty window must be positive")
+	}
+	for _, s := range c.Steps {
+		if s.Offences < 1 {
+			return fmt.Errorf("penalty step needs at least 1 offence")
+		}
+		switch s.Action {
+		case actionWarning:
+		case actionLockout, actionLowPriority:
+			if s.Duration <= 0 {
+				return fmt.Errorf("penalty step %q after %d offences needs a duration", s.Action, s.Offences)
+			}
+		default:
+			return fmt.Errorf("unknown penalty action %q", s.Action)
+		}
+	}
+	return nil
+}
+
+// step returns the escalation step reached with the given number of offences.
+func (c PenaltyConfig) step(offences int) (PenaltyStep, bool) {
+	var best PenaltyStep
+	found := false
+	for _, s := range c.Steps {
+		if s.Offences <= offences && (!found || s.Offences > best.Offences) {
+			best, found = s, true
+		}
+	}
+	return best, found
+}
+
+// PlayerPenalty describes the current standing of a penalised player.
+type PlayerPenalty struct {
+	PlayerID string    `json:"playerId"`
+	Action   string    `json:"action"`
+	Offences int       `json:"offences"` // offences within the rolling window
+	Until    time.Time `json:"until,omitzero"`
+}
+
+// PenaltyError is the body of a join rejected because of a lockout.
+type PenaltyError struct {
+	Error     string          `json:"error"`
+	Message   string          `json:"message"`
+	Penalties []PlayerPenalty `json:"penalties"`
+}
+
+type OffenceReport struct {
+	GameID   string `json:"gameId"`
+	PlayerID string `json:"playerId"`
+}
+
+// offencesKey returns the sorted set of a player's offences scored by time.
+func offencesKey(playerID string) string {
+	return "player:" + playerID + ":offences"
+}
+
+func lockoutKey(playerID string) string {
+	return "player:" + playerID + ":lockout"
+}
+
+// lowPriorityKey holds the delay in milliseconds for as long as the player is
+// in low priority.
+func lowPriorityKey(playerID string) string {
+	return "player:" + playerID + ":lowpriority"
+}
+
+func gameMatchKey(gameID string) string {
+	return "game:" + gameID + ":match"
+}
+
+// recordOffence adds an offence to the player's record and applies the
+// escalation step it reaches. ref identifies the match or game, so the same
+// offence is only counted once.
+func recordOffence(ctx context.Context, q *QueueConfig, playerID, kind, ref string) error {
+	window := time.Duration(config.Penalties.Window)
+	now := time.Now()
+
+	pipe := rdb.TxPipeline()
+	pipe.ZAdd(ctx, offencesKey(playerID), redis.Z{Score: float64(now.UnixMilli()), Member: kind + ":" + ref})
+	pipe.ZRemRangeByScore(ctx, offencesKey(playerID), "-inf", "("+strconv.FormatInt(now.Add(-window).UnixMilli(), 10))
+	count := pipe.ZCard(ctx, offencesKey(playerID))
+	pipe.Expire(ctx, offencesKey(playerID), window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	offences := int(count.Val())
+	penaltyOffences.WithLabelValues(q.Name, kind).Inc()
+
+	step, ok := config.Penalties.step(offences)
+	if !ok {
+		return nil
+	}
+
+	switch step.Action {
+	case actionLockout:
+		if err := rdb.Set(ctx, lockoutKey(playerID), kind, time.Duration(step.Duration)).Err(); err != nil {
+			return err
+		}
+	case actionLowPriority:
+		delay := time.Duration(step.Delay).Milliseconds()
+		if err := rdb.Set(ctx, lowPriorityKey(playerID), delay, time.Duration(step.Duration)).Err(); err != nil {
+			return err
+		}
+	}
+	penaltiesApplied.WithLabelValues(q.Name, step.Action).Inc()
+
+	log.Printf("[%s] Player %s: %s (%d offences), %s", q.Name, playerID, kind, offences, step.Action)
+	return nil
+}
+
+// penaltyStanding returns the penalties of the given players that are in
+// effect right now, and the longest low priority delay among them. Players
+// without offences in the window are left out.
+func penaltyStanding(ctx context.Context, playerIDs []string) ([]PlayerPenalty, time.Duration, error) {
+	since := strconv.FormatInt(time.Now().Add(-time.Duration(config.Penalties.Window)).UnixMilli(), 10)
+
+	pipe := rdb.Pipeline()
+	counts := make([]*redis.IntCmd, len(playerIDs))
+	lockouts := make([]*redis.DurationCmd, len(playerIDs))
+	lowPriorities := make([]*redis.DurationCmd, len(playerIDs))
+	delays := make([]*redis.StringCmd, len(playerIDs))
+	for i, id := range playerIDs {
+		counts[i] = pipe.ZCount(ctx, offencesKey(id), since, "+inf")
+		lockouts[i] = pipe.PTTL(ctx, lockoutKey(id))
+		lowPriorities[i] = pipe.PTTL(ctx, lowPriorityKey(id))
+		delays[i] = pipe.Get(ctx, lowPriorityKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	var penalties []PlayerPenalty
+	var delay time.Duration
+	for i, id := range playerIDs {
+		p := PlayerPenalty{PlayerID: id, Offences: int(counts[i].Val())}
+		// PTTL reports negative values for missing keys
+		if remaining := lockouts[i].Val(); remaining > 0 {
+			p.Action = actionLockout
+			p.Until = now.Add(remaining)
+		} else if remaining := lowPriorities[i].Val(); remaining > 0 {
+			p.Action = actionLowPriority
+			p.Until = now.Add(remaining)
+			if ms, err := delays[i].Int64(); err == nil {
+				delay = max(delay, time.Duration(ms)*time.Millisecond)
+			}
+		} else if p.Offences > 0 {
+			p.Action = actionWarning
+		} else {
+			continue
+		}
+		penalties = append(penalties, p)
+	}
+	return penalties, delay, nil
+}
+
+// writeLockout rejects a join for the locked out players among penalties.
+func writeLockout(w http.ResponseWriter, penalties []PlayerPenalty) {
+	var locked []PlayerPenalty
+	var until time.Time
+	for _, p := range penalties {
+		if p.Action == actionLockout {
+			locked = append(locked, p)
+			if p.Until.After(until) {
+				until = p.Until
+			}
+		}
+	}
+
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(PenaltyError{
+		Error:     "queue_lockout",
+		Message:   fmt.Sprintf("locked out of matchmaking for another %ds", retryAfter),
+		Penalties: locked,
+	})
+}
+
+// handleReport takes early disconnects reported by game servers (through the
+// orchestrator) and counts them as offences of the player.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req OffenceReport
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.GameID == "" || req.PlayerID == "" {
+		http.Error(w, "gameId and playerId are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	// Only players that were actually placed in the game can leave it
+	match, err := loadGameMatch(ctx, req.GameID)
+	if err == redis.Nil {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errCorruptMatch) {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !slices.Contains(match.Players, req.PlayerID) {
+		http.Error(w, "player is not part of the game", http.StatusBadRequest)
+		return
+	}
+	if match.Lobby != "" {
+		// Leaving a private match carries no penalty
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	q, ok := config.Queue(match.Queue)
+	if !ok {
+		http.Error(w, "unknown queue", http.StatusBadRequest)
+		return
+	}
+	if err := recordOffence(ctx, q, req.PlayerID, offenceLeave, req.GameID); err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	// Frees the player's seat for backfills
+	pipe := rdb.Pipeline()
+	pipe.SAdd(ctx, matchLeftKey(match.MatchID), req.PlayerID)
+	pipe.Expire(ctx, matchLeftKey(match.MatchID), 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPenaltyStep(t *testing.T) {
+	// Steps need not be ordered in the config
+	c := PenaltyConfig{
+		Window: Duration(24 * time.Hour),
+		Steps: []PenaltyStep{
+			{Offences: 5, Action: actionLockout, Duration: Duration(time.Hour)},
+			{Offences: 1, Action: actionWarning},
+			{Offences: 3, Action: actionLowPriority, Duration: Duration(10 * time.Minute), Delay: Duration(time.Minute)},
+		},
+	}
+
+	for _, tt := range []struct {
+		offences int
+		want     string // the action, empty if no step is reached
+	}{
+		{0, ""},
+		{1, actionWarning},
+		{2, actionWarning},
+		{3, actionLowPriority},
+		{4, actionLowPriority},
+		{5, actionLockout},
+		{20, actionLockout},
+	} {
+		step, ok := c.step(tt.offences)
+		if ok != (tt.want != "") || step.Action != tt.want {
+			t.Errorf("step(%d) = %+v, %v, want %q", tt.offences, step, ok, tt.want)
+		}
+	}
+}
+
+func TestPenaltyConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		steps []PenaltyStep
+		valid bool
+	}{
+		{"no steps", nil, true},
+		{"escalating", []PenaltyStep{
+			{Offences: 1, Action: actionWarning},
+			{Offences: 3, Action: actionLockout, Duration: Duration(time.Hour)},
+		}, true},
+		{"no offences", []PenaltyStep{{Offences: 0, Action: actionWarning}}, false},
+		{"lockout without duration", []PenaltyStep{{Offences: 1, Action: actionLockout}}, false},
+		{"low priority without duration", []PenaltyStep{{Offences: 1, Action: actionLowPriority}}, false},
+		{"unknown action", []PenaltyStep{{Offences: 1, Action: "ban"}}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := PenaltyConfig{Window: Duration(time.Hour), Steps: tt.steps}
+			if err := c.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+
+	if err := (PenaltyConfig{}).validate(); err == nil {
+		t.Errorf("config without a window is valid")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRating      = 1500.0
+	defaultUncertainty = 350.0
+	defaultVolatility  = 0.06
+)
+
+// Rating is the skill estimate stored per player under rating:{playerId}.
+// Volatility is only used by Glicko-2.
+type Rating struct {
+	Rating      float64 `json:"rating"`
+	Uncertainty float64 `json:"uncertainty"`
+	Volatility  float64 `json:"volatility"`
+}
+
+func ratingKey(playerID string) string {
+	return "rating:" + playerID
+}
+
+// loadRating returns the stored rating of a player. Players without a record
+// are initialised with the default rating so that later reads are stable.
+func loadRating(ctx context.Context, playerID string) (Rating, error) {
+	key := ratingKey(playerID)
+
+	pipe := rdb.TxPipeline()
+	pipe.HSetNX(ctx, key, "rating", defaultRating)
+	pipe.HSetNX(ctx, key, "uncertainty", defaultUncertainty)
+	pipe.HSetNX(ctx, key, "volatility", defaultVolatility)
+	get := pipe.HMGet(ctx, key, "rating", "uncertainty", "volatility")
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return Rating{}, err
+	}
+	return parseRating(get.Val()), nil
+}
+
+// parseRating reads the rating, uncertainty and volatility fields returned by
+// HMGET, keeping the defaults for missing fields.
+func parseRating(vals []interface{}) Rating {
+	r := Rating{Rating: defaultRating, Uncertainty: defaultUncertainty, Volatility: defaultVolatility}
+	fields := []*float64{&r.Rating, &r.Uncertainty, &r.Volatility}
+	for i, v := range vals {
+		if i >= len(fields) {
+			break
+		}
+		if s, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				*fields[i] = f
+			}
+		}
+	}
+	return r
+}
+
+// queuedTicket pairs a ticket with the ID it is stored under.
+type queuedTicket struct {
+	ID string
+	Ticket
+}
+
+// slotsUsed returns the number of players on the given tickets.
+func slotsUsed(tickets []queuedTicket) int {
+	n := 0
+	for _, t := range tickets {
+		n += t.Size()
+	}
+	return n
+}
+
+// ratingSpread returns the difference between the highest and lowest rating in the group.
+func ratingSpread(group []queuedTicket) float64 {
+	if len(group) == 0 {
+		return 0
+	}
+	lo, hi := group[0].Rating, group[0].Rating
+	for _, t := range group[1:] {
+		if t.Rating < lo {
+			lo = t.Rating
+		}
+		if t.Rating > hi {
+			hi = t.Rating
+		}
+	}
+	return hi - lo
+}
+
+// findSkillGroup picks tickets filling teamCount teams of teamSize players.
+// Starting from every position of the rating-sorted queue, tickets are packed
+// greedily into the free slots, skipping tickets (parties) that do not fit, so
+// a match can be made of any mix of party sizes. A candidate is valid when its
+// spread fits the widest search window of its members, so tickets that have
+// waited long loosen the constraint for the group they end up in, and when the
+// parties can be split into full teams. With roles, tickets whose players
+// cannot take any of the role slots left are skipped as well. The tightest
+// valid candidate wins; ties go to the one holding the longest-waiting ticket.
+// The returned window is the search window that admitted the group.
+func findSkillGroup(tickets []queuedTicket, teamCount, teamSize int, roles *RoleConfig, curve WindowCurve, now time.Time) ([]queuedTicket, float64) {
+	slots := teamCount * teamSize
+
+	sorted := make([]queuedTicket, len(tickets))
+	copy(sorted, tickets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Rating < sorted[j].Rating
+	})
+
+	windows := make([]float64, len(sorted))
+	for i, t := range sorted {
+		windows[i] = curve.At(now.Sub(t.queuedSince()))
+	}
+
+	var best []queuedTicket
+	var bestSpread, bestWindow float64
+	var bestOldest time.Time
+	for i := range sorted {
+		var group []queuedTicket
+		remaining := slots
+		window := 0.0
+		oldest := sorted[i].queuedSince()
+		for j := i; j < len(sorted) && remaining > 0; j++ {
+			if sorted[j].Size() > remaining {
+				continue
+			}
+			if roles != nil && !roles.fits(append(group, sorted[j]), teamCount) {
+				continue
+			}
+			group = append(group, sorted[j])
+			remaining -= sorted[j].Size()
+			if windows[j] > window {
+				window = windows[j]
+			}
+			if sorted[j].queuedSince().Before(oldest) {
+				oldest = sorted[j].queuedSince()
+			}
+		}
+		if remaining > 0 {
+			continue
+		}
+
+		spread := ratingSpread(group)
+		if spread > window {
+			continue
+		}
+		if best != nil && (spread > bestSpread || (spread == bestSpread && !oldest.Before(bestOldest))) {
+			continue
+		}
+		if balanceTeams(group, teamCount, teamSize, roles) == nil {
+			continue
+		}
+
+		best = group
+		bestSpread = spread
+		bestWindow = window
+		bestOldest = oldest
+	}
+
+	return best, bestWindow
+}
+
+// findQueueOrderGroup fills teamCount teams of teamSize players in queue order,
+// skipping parties that do not fit the remaining slots. Ratings are ignored.
+// With roles, tickets are taken in the order they count as queued, so fill
+// players move ahead, and tickets that do not fit the role slots left are
+// skipped.
+func findQueueOrderGroup(tickets []queuedTicket, teamCount, teamSize int, roles *RoleConfig) []queuedTicket {
+	if roles != nil {
+		tickets = slices.Clone(tickets)
+		sort.SliceStable(tickets, func(i, j int) bool {
+			return tickets[i].queuedSince().Before(tickets[j].queuedSince())
+		})
+	}
+
+	var group []queuedTicket
+	remaining := teamCount * teamSize
+	for _, t := range tickets {
+		if remaining == 0 {
+			break
+		}
+		if t.Size() > remaining {
+			continue
+		}
+		if roles != nil && !roles.fits(append(group, t), teamCount) {
+			continue
+		}
+		group = append(group, t)
+		remaining -= t.Size()
+	}
+	if remaining > 0 || balanceTeams(group, teamCount, teamSize, roles) == nil {
+		return nil
+	}
+	return group
+}
+
+// groupWindow returns the widest search window among the tickets of a group.
+func groupWindow(group []queuedTicket, curve WindowCurve, now time.Time) float64 {
+	window := 0.0
+	for _, t := range group {
+		if w := curve.At(now.Sub(t.queuedSince())); w > window {
+			window = w
+		}
+	}
+	return window
+}
+
+// backfillGroup picks candidates for the slots a partially claimed group is
+// missing. With a search window, candidates closest to the group's average
+// rating are preferred and the completed group must still fit the window;
+// otherwise candidates are taken in queue order. It returns nil if the group
+// cannot be completed.
+func backfillGroup(claimed, candidates []queuedTicket, q *QueueConfig, now time.Time) []queuedTicket {
+	remaining := q.MatchSize() - slotsUsed(claimed)
+	if remaining <= 0 {
+		return nil
+	}
+
+	ordered := make([]queuedTicket, len(candidates))
+	copy(ordered, candidates)
+	if q.SearchWindow != nil && len(claimed) > 0 {
+		var mean float64
+		for _, t := range claimed {
+			mean += t.Rating / float64(len(claimed))
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return math.Abs(ordered[i].Rating-mean) < math.Abs(ordered[j].Rating-mean)
+		})
+	}
+
+	var fill []queuedTicket
+	for _, t := range ordered {
+		if remaining == 0 {
+			break
+		}
+		if t.Size() > remaining {
+			continue
+		}
+		if q.Roles != nil && !q.Roles.fits(append(append(slices.Clone(claimed), fill...), t), q.TeamCount) {
+			continue
+		}
+		fill = append(fill, t)
+		remaining -= t.Size()
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	group := append(append([]queuedTicket{}, claimed...), fill...)
+	if q.SearchWindow != nil && ratingSpread(group) > groupWindow(group, *q.SearchWindow, now) {
+		return nil
+	}
+	if balanceTeams(group, q.TeamCount, q.TeamSize, q.Roles) == nil {
+		return nil
+	}
+	return fill
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testTicket returns a ticket with a player per rating, queued since the
+// given time. Its ID is that of its first player.
+func testTicket(id string, since time.Time, ratings ...float64) queuedTicket {
+	t := queuedTicket{ID: id, Ticket: Ticket{PlayerID: id, CreatedAt: since}}
+	var sum float64
+	for i, r := range ratings {
+		playerID := id
+		if i > 0 {
+			playerID = fmt.Sprintf("%s-%d", id, i)
+		}
+		t.Players = append(t.Players, TicketPlayer{PlayerID: playerID, Rating: r})
+		sum += r
+	}
+	t.Rating = sum / float64(len(ratings))
+	return t
+}
+
+// ticketIDs returns the IDs of the tickets, sorted.
+func ticketIDs(tickets []queuedTicket) []string {
+	var ids []string
+	for _, t := range tickets {
+		ids = append(ids, t.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestFindSkillGroup(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fixed := WindowCurve{Kind: "linear", Initial: 100, Max: 100}
+	growing := WindowCurve{Kind: "linear", Initial: 100, Growth: 10, Max: 1000}
+
+	for _, tt := range []struct {
+		name      string
+		tickets   []queuedTicket
+		teamCount int
+		teamSize  int
+		curve     WindowCurve
+		want      []string
+		window    float64
+	}{
+		{
+			name: "tightest pair",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1000), testTicket("b", now, 1500), testTicket("c", now, 1550),
+				testTicket("d", now, 1590), testTicket("e", now, 2000),
+			},
+			teamCount: 2, teamSize: 1, curve: fixed,
+			want: []string{"c", "d"}, window: 100,
+		},
+		{
+			name:      "spread too wide",
+			tickets:   []queuedTicket{testTicket("a", now, 1000), testTicket("b", now, 1500)},
+			teamCount: 2, teamSize: 1, curve: fixed,
+		},
+		{
+			name:      "window grows with the wait",
+			tickets:   []queuedTicket{testTicket("a", now.Add(-time.Minute), 1000), testTicket("b", now, 1500)},
+			teamCount: 2, teamSize: 1, curve: growing,
+			want: []string{"a", "b"}, window: 700,
+		},
+		{
+			name: "ties go to the longest wait",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1000), testTicket("b", now, 1050),
+				testTicket("c", now.Add(-time.Second), 2000), testTicket("d", now, 2050),
+			},
+			teamCount: 2, teamSize: 1, curve: fixed,
+			want: []string{"c", "d"}, window: 100,
+		},
+		{
+			name: "parties fill the teams",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1500, 1500, 1500), testTicket("b", now, 1510),
+				testTicket("c", now, 1520, 1520),
+			},
+			teamCount: 2, teamSize: 3, curve: fixed,
+			want: []string{"a", "b", "c"}, window: 100,
+		},
+		{
+			name:      "parties cannot be split into teams",
+			tickets:   []queuedTicket{testTicket("a", now, 1500, 1500), testTicket("b", now, 1500, 1500)},
+			teamCount: 2, teamSize: 1, curve: fixed,
+		},
+		{
+			name:      "not enough players",
+			tickets:   []queuedTicket{testTicket("a", now, 1500)},
+			teamCount: 2, teamSize: 1, curve: fixed,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			group, window := findSkillGroup(tt.tickets, tt.teamCount, tt.teamSize, nil, tt.curve, now)
+			if got := ticketIDs(group); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if group != nil && window != tt.window {
+				t.Errorf("got window %v, want %v", window, tt.window)
+			}
+		})
+	}
+}
+
+func TestRatingSpread(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name  string
+		group []queuedTicket
+		want  float64
+	}{
+		{"empty", nil, 0},
+		{"single", []queuedTicket{testTicket("a", now, 1500)}, 0},
+		{"several", []queuedTicket{testTicket("a", now, 1500), testTicket("b", now, 1200), testTicket("c", now, 1800)}, 600},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ratingSpread(tt.group); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Rating algorithms selectable in queues.json.
+const (
+	algorithmElo       = "elo"
+	algorithmGlicko2   = "glicko2"
+	algorithmTrueSkill = "trueskill"
+)
+
+// RatingConfig selects the algorithm that updates ratings from match results
+// and its parameters. Parameters of other algorithms are ignored.
+type RatingConfig struct {
+	Algorithm string `json:"algorithm"`
+	// Elo: the largest change of a single result
+	KFactor float64 `json:"kFactor,omitempty"`
+	// Glicko-2: constrains how fast volatility changes
+	Tau float64 `json:"tau,omitempty"`
+	// TrueSkill: chance of a draw between equal teams
+	DrawProbability float64 `json:"drawProbability,omitempty"`
+	// Number of results kept per player under rating:{playerId}:history
+	HistoryLength int64 `json:"historyLength,omitempty"`
+}
+
+// RatingAlgorithm computes new ratings from the outcome of a match.
+type RatingAlgorithm interface {
+	// Update returns the new rating of every player, by team, from the
+	// ratings before the match and the rank of each team: 0 for the winner,
+	// and equal ranks for teams that drew.
+	Update(teams [][]Rating, ranks []int) [][]Rating
+}
+
+// newRatingAlgorithm returns the configured algorithm, filling in defaults for
+// its parameters.
+func newRatingAlgorithm(c *RatingConfig) (RatingAlgorithm, error) {
+	switch c.Algorithm {
+	case algorithmElo:
+		if c.KFactor <= 0 {
+			c.KFactor = 32
+		}
+		return elo{k: c.KFactor}, nil
+	case algorithmGlicko2:
+		if c.Tau <= 0 {
+			c.Tau = 0.5
+		}
+		return glicko2{tau: c.Tau}, nil
+	case algorithmTrueSkill:
+		if c.DrawProbability <= 0 || c.DrawProbability >= 1 {
+			c.DrawProbability = 0.1
+		}
+		return newTrueSkill(c.DrawProbability), nil
+	default:
+		return nil, fmt.Errorf("unknown rating algorithm %q", c.Algorithm)
+	}
+}
+
+// rankTeams ranks teams by score, highest first. Teams with equal scores
+// share a rank.
+func rankTeams(scores []float64) []int {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	ranks := make([]int, len(scores))
+	for pos, team := range order {
+		if pos > 0 && scores[team] == scores[order[pos-1]] {
+			ranks[team] = ranks[order[pos-1]]
+		} else {
+			ranks[team] = pos
+		}
+	}
+	return ranks
+}
+
+// outcome returns the result of team a against team b: 1 for a win, 0.5 for
+// a draw and 0 for a loss.
+func outcome(ranks []int, a, b int) float64 {
+	switch {
+	case ranks[a] < ranks[b]:
+		return 1
+	case ranks[a] == ranks[b]:
+		return 0.5
+	default:
+		return 0
+	}
+}
+
+// teamAverage returns the average rating and the root mean square uncertainty
+// of a team, which stand in for the team as a single opponent.
+func teamAverage(team []Rating) (rating, uncertainty float64) {
+	for _, r := range team {
+		rating += r.Rating
+		uncertainty += r.Uncertainty * r.Uncertainty
+	}
+	n := float64(len(team))
+	return rating / n, math.Sqrt(uncertainty / n)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// approx reports whether got is within tolerance of want.
+func approx(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+func TestRankTeams(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		scores []float64
+		want   []int
+	}{
+		{"win", []float64{3, 1}, []int{0, 1}},
+		{"loss", []float64{1, 3}, []int{1, 0}},
+		{"draw", []float64{2, 2}, []int{0, 0}},
+		{"shared second place", []float64{10, 30, 30, 5}, []int{2, 0, 0, 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rankTeams(tt.scores)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEloUpdate(t *testing.T) {
+	player := func(rating float64) []Rating {
+		return []Rating{{Rating: rating, Uncertainty: defaultUncertainty, Volatility: defaultVolatility}}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		teams [][]Rating
+		ranks []int
+		want  []float64 // new rating of the first player of each team
+	}{
+		{"equal teams, first wins", [][]Rating{player(1500), player(1500)}, []int{0, 1}, []float64{1516, 1484}},
+		{"equal teams draw", [][]Rating{player(1500), player(1500)}, []int{0, 0}, []float64{1500, 1500}},
+		{"underdog wins", [][]Rating{player(1400), player(1600)}, []int{0, 1}, []float64{1424.31, 1575.69}},
+		{"favourite wins", [][]Rating{player(1600), player(1400)}, []int{0, 1}, []float64{1607.69, 1392.31}},
+		{"three teams", [][]Rating{player(1500), player(1500), player(1500)}, []int{0, 1, 2}, []float64{1516, 1500, 1484}},
+		{"team average", [][]Rating{{{Rating: 1300}, {Rating: 1700}}, player(1500)}, []int{0, 1}, []float64{1316, 1484}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := elo{k: 32}.Update(tt.teams, tt.ranks)
+			for i, want := range tt.want {
+				if !approx(got[i][0].Rating, want, 0.01) {
+					t.Errorf("team %d: got %.2f, want %.2f", i, got[i][0].Rating, want)
+				}
+				if got[i][0].Uncertainty != tt.teams[i][0].Uncertainty {
+					t.Errorf("team %d: uncertainty changed to %v", i, got[i][0].Uncertainty)
+				}
+			}
+		})
+	}
+}
+
+func TestGlicko2Update(t *testing.T) {
+	// The worked example of Glickman's "Example of the Glicko-2 system": each
+	// opponent is a team of its own
+	teams := [][]Rating{
+		{{Rating: 1500, Uncertainty: 200, Volatility: 0.06}},
+		{{Rating: 1400, Uncertainty: 30, Volatility: 0.06}},
+		{{Rating: 1550, Uncertainty: 100, Volatility: 0.06}},
+		{{Rating: 1700, Uncertainty: 300, Volatility: 0.06}},
+	}
+	got := glicko2{tau: 0.5}.Update(teams, []int{1, 2, 0, 0})[0][0]
+	if !approx(got.Rating, 1464.06, 0.05) || !approx(got.Uncertainty, 151.52, 0.05) || !approx(got.Volatility, 0.05999, 0.00001) {
+		t.Errorf("got %+v, want rating 1464.06, uncertainty 151.52, volatility 0.05999", got)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		ranks []int
+		check func(winner, loser Rating) bool
+	}{
+		{"win", []int{0, 1}, func(a, b Rating) bool { return a.Rating > 1500 && b.Rating < 1500 }},
+		{"draw", []int{0, 0}, func(a, b Rating) bool { return approx(a.Rating, 1500, 1e-9) && approx(b.Rating, 1500, 1e-9) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			player := Rating{Rating: 1500, Uncertainty: 200, Volatility: 0.06}
+			got := glicko2{tau: 0.5}.Update([][]Rating{{player}, {player}}, tt.ranks)
+			if !tt.check(got[0][0], got[1][0]) {
+				t.Errorf("unexpected ratings %+v", got)
+			}
+			for _, team := range got {
+				if team[0].Uncertainty >= player.Uncertainty {
+					t.Errorf("uncertainty did not shrink: %+v", team[0])
+				}
+			}
+		})
+	}
+}
+
+func TestTrueSkillUpdate(t *testing.T) {
+	// The default ratings are the original defaults scaled by 42, so a game
+	// between two new players moves them by 42 times the reference values
+	// (29.396 and 20.604 at 7.171 after a win, 25 at 6.458 after a draw).
+	player := []Rating{{Rating: defaultRating, Uncertainty: defaultUncertainty}}
+	for _, tt := range []struct {
+		name        string
+		teams       [][]Rating
+		ranks       []int
+		want        []float64
+		uncertainty float64
+	}{
+		{"win", [][]Rating{player, player}, []int{0, 1}, []float64{1684.62, 1315.38}, 301.2},
+		{"loss", [][]Rating{player, player}, []int{1, 0}, []float64{1315.38, 1684.62}, 301.2},
+		{"draw", [][]Rating{player, player}, []int{0, 0}, []float64{1500, 1500}, 271.2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newTrueSkill(0.1).Update(tt.teams, tt.ranks)
+			for i, want := range tt.want {
+				r := got[i][0]
+				if !approx(r.Rating, want, 0.5) || !approx(r.Uncertainty, tt.uncertainty, 0.5) {
+					t.Errorf("team %d: got %+v, want rating %.2f, uncertainty %.1f", i, r, want, tt.uncertainty)
+				}
+			}
+		})
+	}
+
+	t.Run("three teams", func(t *testing.T) {
+		got := newTrueSkill(0.1).Update([][]Rating{player, player, player}, []int{0, 1, 2})
+		if !(got[0][0].Rating > got[1][0].Rating && got[1][0].Rating > got[2][0].Rating) {
+			t.Errorf("ratings do not follow the ranks: %+v", got)
+		}
+		if !approx(got[1][0].Rating, defaultRating, 1e-6) {
+			t.Errorf("middle team moved to %v", got[1][0].Rating)
+		}
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// ReadyCheckConfig controls the accept prompt players get before a server is
+// started for their match.
+type ReadyCheckConfig struct {
+	Timeout Duration `json:"timeout"` // time every player has to accept
+}
+
+// Responses of a single player to a ready check.
+const (
+	responsePending  = "pending"
+	responseAccepted = "accepted"
+	responseDeclined = "declined"
+)
+
+// Outcomes of a ready check, also used as metric labels.
+const (
+	outcomeAccepted = "accepted"
+	outcomeDeclined = "declined"
+	outcomeTimeout  = "timeout"
+)
+
+// readyCheck is a proposed match waiting for its players to accept. The
+// responses are kept in a separate hash keyed by player ID.
+type readyCheck struct {
+	MatchID   string         `json:"matchId"`
+	Queue     string         `json:"queue"`
+	Region    string         `json:"region"`
+	Tickets   []string       `json:"tickets"`
+	Bots      []TicketPlayer `json:"bots,omitempty"` // filling the empty slots, see BotFillConfig
+	Window    float64        `json:"window"`         // search window the group was formed with
+	CreatedAt time.Time      `json:"createdAt"`
+	Deadline  time.Time      `json:"deadline"`
+}
+
+type AcceptRequest struct {
+	PlayerID string `json:"id"`
+	Accept   *bool  `json:"accept"`
+}
+
+func readyCheckKey(matchID string) string {
+	return "readycheck:" + matchID
+}
+
+func readyCheckResponsesKey(matchID string) string {
+	return "readycheck:" + matchID + ":responses"
+}
+
+// readyChecksKey returns the sorted set of open ready checks of a queue, scored
+// by their deadline.
+func readyChecksKey(q *QueueConfig) string {
+	return "readychecks:" + q.Name
+}
+
+// respondScript stores the response ARGV[2] of player ARGV[1] in the ready
+// check KEYS[1] if the player has not answered yet. It returns the previous
+// response, or false if the player is not part of an open ready check.
+var respondScript = redis.NewScript(`
+	local current = redis.call("HGET", KEYS[1], ARGV[1])
+	if current == "pending" then
+		redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	end
+	return current
+`)
+
+// closeScript removes the ready check ARGV[1] (KEYS[1] data, KEYS[2] responses,
+// KEYS[3] queue index) so that later responses are rejected, and returns the
+// final responses as a flat list of player IDs and responses. It returns nil
+// if the check was closed already, e.g. by another replica.
+var closeScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		redis.call("ZREM", KEYS[3], ARGV[1])
+		return false
+	end
+	local responses = redis.call("HGETALL", KEYS[2])
+	redis.call("DEL", KEYS[1], KEYS[2])
+	redis.call("ZREM", KEYS[3], ARGV[1])
+	return responses
+`)
+
+// openReadyCheck asks the players of a claimed group to accept the match. The
+// tickets move to pending_accept and the worker picks the check up again in
+// resolveReadyChecks. Bots always accept.
+func openReadyCheck(ctx context.Context, q *QueueConfig, region string, group []queuedTicket, bots []TicketPlayer, window float64) error {
+	timeout := time.Duration(config.ReadyCheck.Timeout)
+	now := time.Now()
+	check := readyCheck{
+		MatchID:   uuid.New().String(),
+		Queue:     q.Name,
+		Region:    region,
+		Bots:      bots,
+		Window:    window,
+		CreatedAt: now,
+		Deadline:  now.Add(timeout),
+	}
+
+	responses := make(map[string]interface{})
+	patches := make([]map[string]interface{}, 0, len(group))
+	for _, t := range group {
+		check.Tickets = append(check.Tickets, t.ID)
+		for _, p := range t.Players {
+			responses[p.PlayerID] = responsePending
+		}
+		patches = append(patches, map[string]interface{}{
+			"matchId":        check.MatchID,
+			"acceptDeadline": check.Deadline,
+		})
+	}
+
+	checkJSON, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+
+	// Keep the check around past its deadline so that a worker taking over the
+	// queue still finds it
+	ttl := timeout + time.Minute
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, readyCheckKey(check.MatchID), checkJSON, ttl)
+	pipe.HSet(ctx, readyCheckResponsesKey(check.MatchID), responses)
+	pipe.Expire(ctx, readyCheckResponsesKey(check.MatchID), ttl)
+	pipe.ZAdd(ctx, readyChecksKey(q), redis.Z{Score: float64(check.Deadline.UnixMilli()), Member: check.MatchID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("saving ready check: %w", err)
+	}
+
+	if err := transitionTickets(ctx, check.Tickets, StatusMatching, StatusPendingAccept, patches); err != nil {
+		rdb.Del(ctx, readyCheckKey(check.MatchID), readyCheckResponsesKey(check.MatchID))
+		rdb.ZRem(ctx, readyChecksKey(q), check.MatchID)
+		return fmt.Errorf("updating tickets: %w", err)
+	}
+
+	log.Printf("[%s] Ready check %s opened for tickets: %v", q.Name, check.MatchID, check.Tickets)
+	return nil
+}
+
+// resolveReadyChecks starts the matches of the queue that every player accepted
+// and breaks up those that were declined or timed out. Checks still waiting for
+// responses are left alone. It stops once the worker loses the queue's lease.
+func resolveReadyChecks(ctx context.Context, q *QueueConfig, lease *queueLease) error {
+	ids, err := rdb.ZRange(ctx, readyChecksKey(q), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, matchID := range ids {
+		if !lease.Held() {
+			return nil
+		}
+		val, err := rdb.Get(ctx, readyCheckKey(matchID)).Result()
+		if err == redis.Nil {
+			// Expired without a worker resolving it
+			rdb.ZRem(ctx, readyChecksKey(q), matchID)
+			continue
+		} else if err != nil {
+			return err
+		}
+		var check readyCheck
+		if err := json.Unmarshal([]byte(val), &check); err != nil {
+			rdb.ZRem(ctx, readyChecksKey(q), matchID)
+			continue
+		}
+
+		responses, err := rdb.HGetAll(ctx, readyCheckResponsesKey(matchID)).Result()
+		if err != nil {
+			return err
+		}
+		if readyCheckOutcome(responses, check.Deadline, time.Now()) == "" {
+			continue
+		}
+
+		// Close the check first so that no response changes after the decision
+		flat, err := closeScript.Run(ctx, rdb, []string{readyCheckKey(matchID), readyCheckResponsesKey(matchID), readyChecksKey(q)}, matchID).StringSlice()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(flat) == 0 {
+			// The responses expired, so nobody can be blamed: everyone queues again
+			log.Printf("[%s] Ready check %s closed without responses", q.Name, matchID)
+			if err := requeueUndecided(ctx, q, check); err != nil {
+				log.Printf("[%s] Requeueing tickets of ready check %s failed: %v", q.Name, matchID, err)
+			}
+			continue
+		}
+		responses = make(map[string]string, len(flat)/2)
+		for i := 0; i+1 < len(flat); i += 2 {
+			responses[flat[i]] = flat[i+1]
+		}
+		outcome := readyCheckOutcome(responses, check.Deadline, time.Now())
+
+		readyChecks.WithLabelValues(q.Name, outcome).Inc()
+		readyCheckDuration.WithLabelValues(q.Name).Observe(time.Since(check.CreatedAt).Seconds())
+
+		if err := finishReadyCheck(ctx, q, check, responses, outcome); err != nil {
+			log.Printf("[%s] Finishing ready check %s failed: %v", q.Name, matchID, err)
+		}
+	}
+	return nil
+}
+
+// requeueUndecided puts the tickets of a ready check that could not be decided
+// back into the queue, without penalties.
+func requeueUndecided(ctx context.Context, q *QueueConfig, check readyCheck) error {
+	group, err := loadTickets(ctx, check.Tickets)
+	if err != nil {
+		return err
+	}
+	return releaseTickets(ctx, q, StatusPendingAccept, group, func(t queuedTicket) (string, map[string]interface{}) {
+		return StatusSearching, map[string]interface{}{
+			"matchId":        nil,
+			"acceptDeadline": nil,
+		}
+	})
+}
+
+// readyCheckOutcome decides a ready check from the players' responses. It
+// returns an empty string while the check is still waiting for responses.
+func readyCheckOutcome(responses map[string]string, deadline, now time.Time) string {
+	accepted := len(responses) > 0
+	for _, r := range responses {
+		if r == responseDeclined {
+			return outcomeDeclined
+		}
+		if r != responseAccepted {
+			accepted = false
+		}
+	}
+	if accepted {
+		return outcomeAccepted
+	}
+	if now.After(deadline) {
+		return outcomeTimeout
+	}
+	return ""
+}
+
+// finishReadyCheck starts the match once everyone accepted. Otherwise tickets
+// whose players all accepted go back to the front of the queue, and the others
+// are dropped and the players who did not accept get an offence on their
+// penalty record.
+func finishReadyCheck(ctx context.Context, q *QueueConfig, check readyCheck, responses map[string]string, outcome string) error {
+	if outcome == "" {
+		return fmt.Errorf("ready check %s is undecided", check.MatchID)
+	}
+	group, err := loadTickets(ctx, check.Tickets)
+	if err != nil {
+		return err
+	}
+
+	if outcome == outcomeAccepted {
+		patches := make([]map[string]interface{}, len(check.Tickets))
+		for i := range patches {
+			patches[i] = map[string]interface{}{}
+		}
+		if err := transitionTickets(ctx, check.Tickets, StatusPendingAccept, StatusMatching, patches); err != nil {
+			// A ticket disappeared, the rest has to find another match
+			return errors.Join(err, releaseTickets(ctx, q, StatusPendingAccept, group, nil))
+		}
+		for i := range group {
+			group[i].Status = StatusMatching
+		}
+
+		log.Printf("[%s] Ready check %s accepted, creating match...", q.Name, check.MatchID)
+		if err := createMatch(ctx, q, check.MatchID, check.Region, group, check.Bots, check.Window); err != nil {
+			log.Printf("Failed to create match: %v", err)
+			if errors.Is(err, errMatchNotCommitted) {
+				// The server was fine, so the tickets are not charged an attempt
+				return errors.Join(err, releaseTickets(ctx, q, StatusMatching, group, nil))
+			}
+			return requeueTickets(ctx, q, group, err)
+		}
+		return nil
+	}
+
+	reason := "match was declined"
+	if outcome == outcomeTimeout {
+		reason = "match was not accepted in time"
+	}
+
+	var dodgers []string
+	var requeued int
+	err = releaseTickets(ctx, q, StatusPendingAccept, group, func(t queuedTicket) (string, map[string]interface{}) {
+		var ticketDodgers []string
+		for _, p := range t.Players {
+			if responses[p.PlayerID] != responseAccepted {
+				ticketDodgers = append(ticketDodgers, p.PlayerID)
+			}
+		}
+		if len(ticketDodgers) == 0 {
+			requeued++
+			return StatusSearching, map[string]interface{}{
+				"matchId":        nil,
+				"acceptDeadline": nil,
+			}
+		}
+		dodgers = append(dodgers, ticketDodgers...)
+		return StatusDeclined, map[string]interface{}{
+			"failureReason": reason,
+		}
+	})
+
+	for _, id := range dodgers {
+		kind := offenceDodge
+		if responses[id] == responseDeclined {
+			kind = offenceDecline
+		}
+		if perr := recordOffence(ctx, q, id, kind, check.MatchID); perr != nil {
+			err = errors.Join(err, perr)
+		}
+	}
+
+	log.Printf("[%s] Ready check %s %s, requeued %d tickets, %d players dodged", q.Name, check.MatchID, outcome, requeued, len(dodgers))
+	return err
+}
+
+func handleAccept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AcceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.PlayerID == "" || req.Accept == nil {
+		http.Error(w, "id and accept are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	ticketID, err := rdb.Get(ctx, playerTicketKey(req.PlayerID)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	val, err := rdb.Get(ctx, "ticket:"+ticketID).Result()
+	if err == redis.Nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	var ticket Ticket
+	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	}
+
+	if ticket.Status != StatusPendingAccept {
+		http.Error(w, fmt.Sprintf("ticket is %s, there is no match to accept", ticket.Status), http.StatusConflict)
+		return
+	}
+	if time.Now().After(ticket.AcceptDeadline) {
+		http.Error(w, "the match was not accepted in time", http.StatusConflict)
+		return
+	}
+
+	response := responseDeclined
+	if *req.Accept {
+		response = responseAccepted
+	}
+	prev, err := respondScript.Run(ctx, rdb, []string{readyCheckResponsesKey(ticket.MatchID)}, req.PlayerID, response).Text()
+	if err == redis.Nil {
+		http.Error(w, "the ready check is already over", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if prev != responsePending {
+		http.Error(w, fmt.Sprintf("match was already %s", prev), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"matchId":  ticket.MatchID,
+		"response": response,
+	})
+}
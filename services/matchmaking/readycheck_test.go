@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadyCheckOutcome(t *testing.T) {
+	deadline := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	before := deadline.Add(-time.Second)
+	after := deadline.Add(time.Second)
+
+	for _, tt := range []struct {
+		name      string
+		responses map[string]string
+		now       time.Time
+		want      string
+	}{
+		{"all accepted", map[string]string{"p1": responseAccepted, "p2": responseAccepted}, before, outcomeAccepted},
+		{"all accepted after the deadline", map[string]string{"p1": responseAccepted, "p2": responseAccepted}, after, outcomeAccepted},
+		{"one declined", map[string]string{"p1": responseAccepted, "p2": responseDeclined}, before, outcomeDeclined},
+		{"declined while others are pending", map[string]string{"p1": responsePending, "p2": responseDeclined}, before, outcomeDeclined},
+		{"declined after the deadline", map[string]string{"p1": responsePending, "p2": responseDeclined}, after, outcomeDeclined},
+		{"waiting", map[string]string{"p1": responseAccepted, "p2": responsePending}, before, ""},
+		{"timed out", map[string]string{"p1": responseAccepted, "p2": responsePending}, after, outcomeTimeout},
+		{"no responses", nil, before, ""},
+		{"no responses after the deadline", nil, after, outcomeTimeout},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readyCheckOutcome(tt.responses, deadline, tt.now); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
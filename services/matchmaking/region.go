@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// acceptablePing reports whether a ticket may play in the region, given how
+// far its ping window has relaxed. Tickets without ping measurements are
+// accepted everywhere.
+func acceptablePing(t queuedTicket, region string, curve WindowCurve, now time.Time) bool {
+	if len(t.Pings) == 0 {
+		return true
+	}
+	ping, ok := t.Pings[region]
+	return ok && float64(ping) <= curve.At(now.Sub(t.queuedSince()))
+}
+
+// ticketsInRegion returns the tickets that may play in the region, keeping
+// their queue order.
+func ticketsInRegion(tickets []queuedTicket, region string, curve WindowCurve, now time.Time) []queuedTicket {
+	var in []queuedTicket
+	for _, t := range tickets {
+		if acceptablePing(t, region, curve, now) {
+			in = append(in, t)
+		}
+	}
+	return in
+}
+
+// maxPing returns the highest ping to the region among the tickets that
+// measured one.
+func maxPing(group []queuedTicket, region string) float64 {
+	highest := 0.0
+	for _, t := range group {
+		if ping, ok := t.Pings[region]; ok && float64(ping) > highest {
+			highest = float64(ping)
+		}
+	}
+	return highest
+}
+
+// closestRegion returns the region with the lowest maximum ping for the group,
+// or "" if no ticket measured any ping.
+func closestRegion(group []queuedTicket, regions []string) string {
+	best, bestPing := "", math.Inf(1)
+	for _, region := range regions {
+		measured := false
+		ping := 0.0
+		for _, t := range group {
+			p, ok := t.Pings[region]
+			if !ok {
+				if len(t.Pings) > 0 {
+					// The ticket cannot reach this region at all
+					ping = math.Inf(1)
+				}
+				continue
+			}
+			measured = true
+			ping = math.Max(ping, float64(p))
+		}
+		if measured && ping < bestPing {
+			best, bestPing = region, ping
+		}
+	}
+	return best
+}
+
+// findGroup picks the next group of the queue with find, and the region to
+// host it. With a ping window, only tickets that can all play in the same
+// region are grouped: every region is searched and the group with the
+// smallest rating spread wins (in rated queues), ties going to the group
+// holding the oldest ticket, then to the lower ping.
+// Without one, the group is placed in the region closest to its players.
+func findGroup(tickets []queuedTicket, q *QueueConfig, regions []string, now time.Time, find func([]queuedTicket) []queuedTicket) ([]queuedTicket, string) {
+	if q.PingWindow == nil {
+		group := find(tickets)
+		return group, closestRegion(group, regions)
+	}
+
+	var best []queuedTicket
+	bestRegion := ""
+	var bestSpread, bestPing float64
+	var bestOldest time.Time
+	for _, region := range regions {
+		group := find(ticketsInRegion(tickets, region, *q.PingWindow, now))
+		if group == nil {
+			continue
+		}
+
+		spread := 0.0
+		if q.SearchWindow != nil {
+			spread = ratingSpread(group)
+		}
+		oldest := group[0].queuedSince()
+		for _, t := range group[1:] {
+			if t.queuedSince().Before(oldest) {
+				oldest = t.queuedSince()
+			}
+		}
+		ping := maxPing(group, region)
+		if best != nil {
+			if spread != bestSpread {
+				if spread > bestSpread {
+					continue
+				}
+			} else if !oldest.Equal(bestOldest) {
+				if oldest.After(bestOldest) {
+					continue
+				}
+			} else if ping >= bestPing {
+				continue
+			}
+		}
+		best, bestRegion, bestSpread, bestOldest, bestPing = group, region, spread, oldest, ping
+	}
+	return best, bestRegion
+}
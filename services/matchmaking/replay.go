@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecordedTicket is one line of a ticket recording: a ticket as it was
+// created on join.
+type RecordedTicket struct {
+	TicketID string `json:"ticketId"`
+	Ticket
+}
+
+// ticketRecorder appends every new ticket to a file as JSON lines, for
+// replaying offline. It is nil unless TICKET_RECORDING is set.
+var ticketRecorder *recorder
+
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) record(ticketID string, t Ticket) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(RecordedTicket{TicketID: ticketID, Ticket: t})
+}
+
+// replayWindow is the search window used when a queue without one is replayed
+// with skill matching.
+var replayWindow = WindowCurve{Kind: "linear", Initial: 100, Max: 1000, Growth: 10}
+
+// runReplay implements "matchmaking replay": it feeds a ticket recording
+// through a match function on a simulated clock and reports the resulting
+// queue times and match quality. Every proposal is taken to be accepted and
+// allocated at once, and tickets are never cancelled, so it compares match
+// functions rather than predicting production queue times.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configPath := fs.String("config", "queues.json", "queue configuration")
+	ticketsPath := fs.String("tickets", "", "ticket recording (JSON lines, see TICKET_RECORDING)")
+	queueName := fs.String("queue", "", "queue to replay (default queue if empty)")
+	strategy := fs.String("match-function", "", "fifo, skill or role (the queue's own if empty)")
+	tick := fs.Duration("tick", 500*time.Millisecond, "simulated time between matchmaking passes")
+	drain := fs.Duration("drain", 10*time.Minute, "how long to keep matching after the last ticket arrived")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *ticketsPath == "" {
+		return fmt.Errorf("-tickets is required")
+	}
+	if *tick <= 0 {
+		return fmt.Errorf("-tick must be positive")
+	}
+
+	var err error
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	q, ok := config.Queue(*queueName)
+	if !ok {
+		return fmt.Errorf("unknown queue %q", *queueName)
+	}
+	if *strategy != "" {
+		if q, err = withMatchFunction(q, *strategy, replayWindow); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(*ticketsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	recorded, err := readRecording(f, q.Name)
+	if err != nil {
+		return err
+	}
+	if len(recorded) == 0 {
+		return fmt.Errorf("no tickets of queue %s in %s", q.Name, *ticketsPath)
+	}
+
+	matcher := matchFunctionFor(q, config.Regions)
+	report := replay(q, matcher, recorded, *tick, *drain)
+	report.print(os.Stdout)
+	return nil
+}
+
+// readRecording reads the recorded tickets of a queue, ordered by creation.
+func readRecording(r io.Reader, queue string) ([]queuedTicket, error) {
+	var tickets []queuedTicket
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rt RecordedTicket
+		if err := json.Unmarshal(scanner.Bytes(), &rt); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rt.Queue != queue {
+			continue
+		}
+		rt.Status = StatusSearching
+		tickets = append(tickets, queuedTicket{ID: rt.TicketID, Ticket: rt.Ticket})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].CreatedAt.Before(tickets[j].CreatedAt)
+	})
+	return tickets, nil
+}
+
+type replayReport struct {
+	queue, matchFunction string
+	tickets, players     int
+	matches, matched     int
+	queueTimes           []float64 // per matched ticket, seconds
+	spreads, gaps, pings []float64 // per match
+}
+
+// replay runs the matchmaking passes of a worker on a simulated clock: every
+// tick the tickets created so far join the queue, the match function sees the
+// head of the queue and its proposals leave it.
+func replay(q *QueueConfig, matcher MatchFunction, recorded []queuedTicket, tick, drain time.Duration) *replayReport {
+	report := &replayReport{queue: q.Name, matchFunction: matcher.Name(), tickets: len(recorded)}
+	for _, t := range recorded {
+		report.players += t.Size()
+	}
+
+	var queue []queuedTicket
+	next := 0
+	end := recorded[len(recorded)-1].CreatedAt.Add(drain)
+	for now := recorded[0].CreatedAt; !now.After(end) && (next < len(recorded) || len(queue) > 0); now = now.Add(tick) {
+		for next < len(recorded) && !recorded[next].CreatedAt.After(now) {
+			queue = append(queue, recorded[next])
+			next++
+		}
+
+		// Same view as loadQueuedTickets
+		var snapshot []queuedTicket
+		for _, t := range queue[:min(len(queue), scanDepth)] {
+			if !t.RetryAt.After(now) {
+				snapshot = append(snapshot, t)
+			}
+		}
+
+		matched := make(map[string]bool)
+		for _, p := range matcher.Propose(snapshot, now) {
+			report.record(q, p, now)
+			for _, t := range p.Tickets {
+				matched[t.ID] = true
+			}
+		}
+		if len(matched) > 0 {
+			rest := queue[:0]
+			for _, t := range queue {
+				if !matched[t.ID] {
+					rest = append(rest, t)
+				}
+			}
+			queue = rest
+		}
+	}
+	return report
+}
+
+func (r *replayReport) record(q *QueueConfig, p Proposal, now time.Time) {
+	r.matches++
+	r.matched += len(p.Tickets)
+	for _, t := range p.Tickets {
+		r.queueTimes = append(r.queueTimes, now.Sub(t.CreatedAt).Seconds())
+	}
+	r.spreads = append(r.spreads, ratingSpread(p.Tickets))
+	if balanced := balanceTeams(p.Tickets, q.TeamCount, q.TeamSize, q.Roles); balanced != nil {
+		r.gaps = append(r.gaps, teamRatingGap(buildTeams(balanced, q.Roles)))
+	}
+	if p.Region != "" {
+		r.pings = append(r.pings, maxPing(p.Tickets, p.Region))
+	}
+}
+
+func (r *replayReport) print(w io.Writer) {
+	fmt.Fprintf(w, "queue %s, match function %s: %d tickets, %d players\n", r.queue, r.matchFunction, r.tickets, r.players)
+	fmt.Fprintf(w, "%-18s %d\n", "matches", r.matches)
+	fmt.Fprintf(w, "%-18s %d (%.1f%%), %d never matched\n", "matched tickets", r.matched, 100*float64(r.matched)/float64(r.tickets), r.tickets-r.matched)
+	printDistribution(w, "queue time (s)", r.queueTimes)
+	printDistribution(w, "rating spread", r.spreads)
+	printDistribution(w, "team rating gap", r.gaps)
+	printDistribution(w, "max ping (ms)", r.pings)
+}
+
+func printDistribution(w io.Writer, name string, values []float64) {
+	if len(values) == 0 {
+		fmt.Fprintf(w, "%-18s -\n", name)
+		return
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	fmt.Fprintf(w, "%-18s p50 %.1f  p90 %.1f  p99 %.1f  max %.1f\n", name,
+		percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), sorted[len(sorted)-1])
+}
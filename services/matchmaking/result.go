@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ratingAlgorithm updates ratings from match results, see RatingConfig.
+var ratingAlgorithm RatingAlgorithm
+
+// MatchResult is the final score of every player in a game, reported by its
+// game server through the orchestrator. A team scores the sum of its players;
+// players without a score, such as leavers, add nothing.
+type MatchResult struct {
+	GameID string             `json:"gameId"`
+	Scores map[string]float64 `json:"scores"`
+}
+
+type RatingChange struct {
+	PlayerID string `json:"playerId"`
+	Team     int    `json:"team"`
+	Before   Rating `json:"before"`
+	After    Rating `json:"after"`
+}
+
+type ResultResponse struct {
+	MatchID string         `json:"matchId"`
+	Ranks   []int          `json:"ranks"`             // per team, 0 for the winner
+	Changes []RatingChange `json:"changes,omitempty"` // empty for queues that are not rated
+}
+
+// RatingHistoryEntry is one rated match in a player's history, newest first
+// under rating:{playerId}:history.
+type RatingHistoryEntry struct {
+	MatchID     string    `json:"matchId"`
+	Queue       string    `json:"queue"`
+	Rank        int       `json:"rank"`
+	Rating      float64   `json:"rating"`
+	Uncertainty float64   `json:"uncertainty"`
+	Change      float64   `json:"change"`
+	At          time.Time `json:"at"`
+}
+
+func ratingHistoryKey(playerID string) string {
+	return ratingKey(playerID) + ":history"
+}
+
+// matchResultKey marks a match whose result was recorded, so that a result is
+// only applied once.
+func matchResultKey(matchID string) string {
+	return "match:" + matchID + ":result"
+}
+
+var errCorruptMatch = errors.New("corrupt match")
+
+// loadGameMatch returns the match played on a game server. It returns
+// redis.Nil if the game or its match is unknown.
+func loadGameMatch(ctx context.Context, gameID string) (Match, error) {
+	matchID, err := rdb.Get(ctx, gameMatchKey(gameID)).Result()
+	if err != nil {
+		return Match{}, err
+	}
+	val, err := rdb.Get(ctx, "match:"+matchID).Result()
+	if err != nil {
+		return Match{}, err
+	}
+	var match Match
+	if err := json.Unmarshal([]byte(val), &match); err != nil {
+		return Match{}, fmt.Errorf("%w %s: %v", errCorruptMatch, matchID, err)
+	}
+	return match, nil
+}
+
+// handleResult records the result of a match and updates the ratings of its
+// players. Results of queues without a search window, of matches with bots,
+// whose ratings are made up, and of private matches do not change ratings.
+func handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MatchResult
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.GameID == "" || len(req.Scores) == 0 {
+		http.Error(w, "gameId and scores are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	match, err := loadGameMatch(ctx, req.GameID)
+	if err == redis.Nil {
+		http.Error(w, "Game not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errCorruptMatch) {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	// Private matches have no queue
+	var q *QueueConfig
+	if match.Lobby == "" {
+		var ok bool
+		if q, ok = config.Queue(match.Queue); !ok {
+			http.Error(w, "unknown queue", http.StatusBadRequest)
+			return
+		}
+	}
+
+	teamScores := make([]float64, len(match.Teams))
+	scored := 0
+	for i, team := range match.Teams {
+		for _, id := range team.Players {
+			if score, ok := req.Scores[id]; ok {
+				teamScores[i] += score
+				scored++
+			}
+		}
+	}
+	if scored != len(req.Scores) {
+		http.Error(w, "scores contain players that are not part of the game", http.StatusBadRequest)
+		return
+	}
+	ranks := rankTeams(teamScores)
+
+	set, err := rdb.SetNX(ctx, matchResultKey(match.MatchID), teamScoresJSON(teamScores), 24*time.Hour).Result()
+	if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !set {
+		http.Error(w, "result already recorded", http.StatusConflict)
+		return
+	}
+
+	response := ResultResponse{MatchID: match.MatchID, Ranks: ranks}
+	if q == nil {
+		log.Printf("Private match %s of lobby %s finished with team scores %v", match.MatchID, match.Lobby, teamScores)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if q.SearchWindow != nil && len(match.Bots) == 0 {
+		response.Changes, err = updateRatings(ctx, q, match, ranks)
+		if err != nil {
+			log.Printf("Updating ratings for match %s failed: %v", match.MatchID, err)
+			// Let the game server report again
+			rdb.Del(ctx, matchResultKey(match.MatchID))
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	matchResults.WithLabelValues(q.Name).Inc()
+
+	log.Printf("[%s] Match %s finished with team scores %v", q.Name, match.MatchID, teamScores)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func teamScoresJSON(scores []float64) string {
+	data, _ := json.Marshal(scores)
+	return string(data)
+}
+
+// updateRatings applies the configured algorithm to the players of a match,
+// stores their new ratings and history, and records how well the ratings had
+// predicted the outcome.
+func updateRatings(ctx context.Context, q *QueueConfig, match Match, ranks []int) ([]RatingChange, error) {
+	before := make([][]Rating, len(match.Teams))
+	for i, team := range match.Teams {
+		before[i] = make([]Rating, len(team.Players))
+		for p, id := range team.Players {
+			rating, err := loadRating(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			before[i][p] = rating
+		}
+	}
+
+	after := ratingAlgorithm.Update(before, ranks)
+
+	now := time.Now()
+	var changes []RatingChange
+	pipe := rdb.TxPipeline()
+	for i, team := range match.Teams {
+		for p, id := range team.Players {
+			old, updated := before[i][p], after[i][p]
+			pipe.HSet(ctx, ratingKey(id), "rating", updated.Rating, "uncertainty", updated.Uncertainty, "volatility", updated.Volatility)
+
+			entry, err := json.Marshal(RatingHistoryEntry{
+				MatchID:     match.MatchID,
+				Queue:       q.Name,
+				Rank:        ranks[i],
+				Rating:      updated.Rating,
+				Uncertainty: updated.Uncertainty,
+				Change:      updated.Rating - old.Rating,
+				At:          now,
+			})
+			if err != nil {
+				return nil, err
+			}
+			pipe.LPush(ctx, ratingHistoryKey(id), entry)
+			pipe.LTrim(ctx, ratingHistoryKey(id), 0, config.Ratings.HistoryLength-1)
+
+			changes = append(changes, RatingChange{PlayerID: id, Team: i, Before: old, After: updated})
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	algorithm := config.Ratings.Algorithm
+	for _, c := range changes {
+		ratingChange.WithLabelValues(q.Name, algorithm).Observe(math.Abs(c.After.Rating - c.Before.Rating))
+		ratingUncertainty.WithLabelValues(q.Name, algorithm).Observe(c.After.Uncertainty)
+	}
+	ratingPredictionBrier.WithLabelValues(q.Name, algorithm).Observe(predictionBrier(match.Teams, ranks))
+	return changes, nil
+}
+
+// predictionBrier returns the Brier score of the win probabilities predicted
+// when the match was made: the squared error summed over teams, with the win
+// shared among teams that tied for first. 0 is a perfect prediction.
+func predictionBrier(teams []Team, ranks []int) float64 {
+	winners := 0
+	for _, rank := range ranks {
+		if rank == 0 {
+			winners++
+		}
+	}
+	var score float64
+	for i, t := range teams {
+		actual := 0.0
+		if ranks[i] == 0 {
+			actual = 1 / float64(winners)
+		}
+		score += (t.WinProbability - actual) * (t.WinProbability - actual)
+	}
+	return score
+}
+
+// handleRating returns a player's current rating and their rating history.
+func handleRating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playerID := r.URL.Query().Get("playerId")
+	if playerID == "" {
+		http.Error(w, "playerId required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	pipe := rdb.Pipeline()
+	get := pipe.HMGet(ctx, ratingKey(playerID), "rating", "uncertainty", "volatility")
+	history := pipe.LRange(ctx, ratingHistoryKey(playerID), 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]RatingHistoryEntry, 0, len(history.Val()))
+	for _, val := range history.Val() {
+		var entry RatingHistoryEntry
+		if err := json.Unmarshal([]byte(val), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"playerId": playerID,
+		"rating":   parseRating(get.Val()),
+		"history":  entries,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RetryConfig controls how tickets are retried after a failed server allocation.
+type RetryConfig struct {
+	MaxAttempts int      `json:"maxAttempts"`
+	Backoff     Duration `json:"backoff"`    // delay after the first failure, doubled per attempt
+	MaxBackoff  Duration `json:"maxBackoff"` // upper bound for the delay
+}
+
+// delay returns how long a ticket waits before it may be matched again after
+// the given number of failed attempts.
+func (c RetryConfig) delay(attempts int) time.Duration {
+	d := time.Duration(c.Backoff)
+	for i := 1; i < attempts && d < time.Duration(c.MaxBackoff); i++ {
+		d *= 2
+	}
+	if d > time.Duration(c.MaxBackoff) {
+		d = time.Duration(c.MaxBackoff)
+	}
+	return d
+}
+
+// requeueTickets puts the tickets of a match that could not be created back at
+// the front of the queue, keeping their original CreatedAt and queue order.
+// Each ticket is held back for a growing backoff, and tickets that ran out of
+// attempts are marked as failed instead.
+func requeueTickets(ctx context.Context, q *QueueConfig, group []queuedTicket, cause error) error {
+	retry := config.AllocationRetry
+	now := time.Now()
+
+	var requeued, failed int
+	err := releaseTickets(ctx, q, StatusMatching, group, func(t queuedTicket) (string, map[string]interface{}) {
+		attempts := t.AllocationAttempts + 1
+		if attempts >= retry.MaxAttempts {
+			failed++
+			return StatusFailed, map[string]interface{}{
+				"allocationAttempts": attempts,
+				"failureReason":      fmt.Sprintf("server allocation failed %d times: %v", attempts, cause),
+			}
+		}
+		requeued++
+		return StatusSearching, map[string]interface{}{
+			"allocationAttempts": attempts,
+			"retryAt":            now.Add(retry.delay(attempts)),
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ticketsRequeued.WithLabelValues(q.Name).Add(float64(requeued))
+	ticketsFailed.WithLabelValues(q.Name).Add(float64(failed))
+	log.Printf("[%s] Requeued %d tickets, %d failed after allocation error", q.Name, requeued, failed)
+	return nil
+}
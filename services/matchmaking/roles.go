@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// roleFill is the role of players willing to play whatever the team is missing.
+const roleFill = "fill"
+
+// RoleConfig makes every team of a queue fill a fixed role composition, such
+// as two duelists and one of each other role.
+type RoleConfig struct {
+	Composition map[string]int `json:"composition"` // players per role in each team
+	// FillBonus is the queue time credited to players who queue as fill, which
+	// widens their windows sooner and moves them ahead of players who queued at
+	// the same time. Parties get the share of their players who fill.
+	FillBonus Duration `json:"fillBonus,omitempty"`
+}
+
+func (c *RoleConfig) validate(teamSize int) error {
+	total := 0
+	for role, n := range c.Composition {
+		if role == "" || role == roleFill {
+			return fmt.Errorf("invalid role %q", role)
+		}
+		if n < 1 {
+			return fmt.Errorf("role %q needs at least 1 player", role)
+		}
+		total += n
+	}
+	if total != teamSize {
+		return fmt.Errorf("role composition has %d players but teams have %d", total, teamSize)
+	}
+	if c.FillBonus < 0 {
+		return fmt.Errorf("fill bonus must not be negative")
+	}
+	return nil
+}
+
+// names returns the roles of the composition in a stable order, without fill.
+func (c *RoleConfig) names() []string {
+	names := make([]string, 0, len(c.Composition))
+	for role := range c.Composition {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// slots returns one entry per role slot of teamCount teams.
+func (c *RoleConfig) slots(teamCount int) []string {
+	var slots []string
+	for _, role := range c.names() {
+		for i := 0; i < c.Composition[role]*teamCount; i++ {
+			slots = append(slots, role)
+		}
+	}
+	return slots
+}
+
+// fits reports whether every player on the tickets can take one of the slots
+// of teamCount teams.
+func (c *RoleConfig) fits(tickets []queuedTicket, teamCount int) bool {
+	return assignRoles(tickets, c.slots(teamCount)) != nil
+}
+
+// fillBonus returns the queue time credited to a ticket with the given players.
+func (c *RoleConfig) fillBonus(players []TicketPlayer) time.Duration {
+	fills := 0
+	for _, p := range players {
+		if slices.Contains(p.Roles, roleFill) {
+			fills++
+		}
+	}
+	return time.Duration(c.FillBonus) * time.Duration(fills) / time.Duration(len(players))
+}
+
+// validateRoles checks the preferred roles of a player against the queue's
+// composition and returns them without duplicates.
+func (c *RoleConfig) validateRoles(roles []string) ([]string, error) {
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("at least one role is required")
+	}
+	var valid []string
+	for _, role := range roles {
+		if _, ok := c.Composition[role]; !ok && role != roleFill {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		if !slices.Contains(valid, role) {
+			valid = append(valid, role)
+		}
+	}
+	return valid, nil
+}
+
+// assignRoles gives every player on the tickets one of the slots, preferring
+// the roles they asked for over filling. It returns the role per player ID, or
+// nil if the players cannot all be placed. Each player is placed by searching
+// for an augmenting path, which is exhaustive and cheap at match sizes.
+func assignRoles(tickets []queuedTicket, slots []string) map[string]string {
+	var players []TicketPlayer
+	for _, t := range tickets {
+		players = append(players, t.Players...)
+	}
+	if len(players) > len(slots) {
+		return nil
+	}
+	// Players with fewer options are placed first and fill players last, so
+	// that fill players end up in the slots nobody else could take.
+	sort.SliceStable(players, func(i, j int) bool {
+		fi, fj := slices.Contains(players[i].Roles, roleFill), slices.Contains(players[j].Roles, roleFill)
+		if fi != fj {
+			return fj
+		}
+		return len(players[i].Roles) < len(players[j].Roles)
+	})
+
+	taken := make([]int, len(slots)) // index into players + 1, 0 while free
+	var place func(p int, seen []bool) bool
+	place = func(p int, seen []bool) bool {
+		roles := players[p].Roles
+		// Try the roles the player asked for before filling
+		for _, filling := range []bool{false, true} {
+			if filling && !slices.Contains(roles, roleFill) {
+				break
+			}
+			for s, role := range slots {
+				if seen[s] || slices.Contains(roles, role) == filling {
+					continue
+				}
+				seen[s] = true
+				if taken[s] == 0 || place(taken[s]-1, seen) {
+					taken[s] = p + 1
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for p := range players {
+		if !place(p, make([]bool, len(slots))) {
+			return nil
+		}
+	}
+
+	assigned := make(map[string]string, len(players))
+	for s, p := range taken {
+		if p > 0 {
+			assigned[players[p-1].PlayerID] = slots[s]
+		}
+	}
+	return assigned
+}
+
+// roleWaitLabel returns the role a placed player's queue time is recorded
+// under: the role they got, or fill if they only got it by filling.
+func roleWaitLabel(p TicketPlayer, assigned string) string {
+	if slices.Contains(p.Roles, assigned) {
+		return assigned
+	}
+	return roleFill
+}
+
+// recordRoleQueue publishes how many players in the scanned part of the queue
+// offer each role and how long the longest waiting of them has waited, which
+// shows the role that holds matches back.
+func recordRoleQueue(q *QueueConfig, tickets []queuedTicket, now time.Time) {
+	depth := make(map[string]int)
+	oldest := make(map[string]time.Duration)
+	for _, t := range tickets {
+		waited := now.Sub(t.CreatedAt)
+		for _, p := range t.Players {
+			for _, role := range p.Roles {
+				depth[role]++
+				oldest[role] = max(oldest[role], waited)
+			}
+		}
+	}
+	for _, role := range append(q.Roles.names(), roleFill) {
+		roleQueueDepth.WithLabelValues(q.Name, role).Set(float64(depth[role]))
+		roleOldestWait.WithLabelValues(q.Name, role).Set(oldest[role].Seconds())
+	}
+}
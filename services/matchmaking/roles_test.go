@@ -0,0 +1,67 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestAssignRoles(t *testing.T) {
+	player := func(id string, roles ...string) queuedTicket {
+		return queuedTicket{ID: id, Ticket: Ticket{Players: []TicketPlayer{{PlayerID: id, Roles: roles}}}}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		tickets []queuedTicket
+		slots   []string
+		want    map[string]string
+	}{
+		{
+			name:    "preferred roles",
+			tickets: []queuedTicket{player("a", "tank"), player("b", "dps"), player("c", "support")},
+			slots:   []string{"dps", "support", "tank"},
+			want:    map[string]string{"a": "tank", "b": "dps", "c": "support"},
+		},
+		{
+			name:    "fill takes what is left",
+			tickets: []queuedTicket{player("a", roleFill), player("b", "tank")},
+			slots:   []string{"dps", "tank"},
+			want:    map[string]string{"a": "dps", "b": "tank"},
+		},
+		{
+			name:    "preferred role before filling",
+			tickets: []queuedTicket{player("a", "tank", roleFill), player("b", roleFill)},
+			slots:   []string{"dps", "tank"},
+			want:    map[string]string{"a": "tank", "b": "dps"},
+		},
+		{
+			name:    "players move to their other role",
+			tickets: []queuedTicket{player("a", "tank", "dps"), player("b", "tank")},
+			slots:   []string{"dps", "tank"},
+			want:    map[string]string{"a": "dps", "b": "tank"},
+		},
+		{
+			name:    "free slots are fine",
+			tickets: []queuedTicket{player("a", "tank")},
+			slots:   []string{"dps", "tank"},
+			want:    map[string]string{"a": "tank"},
+		},
+		{
+			name:    "role taken",
+			tickets: []queuedTicket{player("a", "tank"), player("b", "tank")},
+			slots:   []string{"dps", "tank"},
+		},
+		{
+			name:    "more players than slots",
+			tickets: []queuedTicket{player("a", roleFill), player("b", roleFill), player("c", roleFill)},
+			slots:   []string{"dps", "tank"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assignRoles(tt.tickets, tt.slots)
+			if (got == nil) != (tt.want == nil) || !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Ticket states. A ticket starts out searching. A worker claims it for a match
+// (matching) and asks its players to accept the match (pending_accept). Once
+// everyone accepted, the worker claims it again (matching) and either commits
+// the match (matched), hands it back to the queue (searching) or gives up on it
+// (failed). If someone declines or does not answer in time, the tickets of the
+// players who accepted go back to the queue and the others are dropped
+// (declined). Only searching tickets can be cancelled, so a ticket never holds
+// a seat in a match after it was cancelled. The sweeper ends searching tickets
+// whose client stopped polling or streaming their status (abandoned).
+const (
+	StatusSearching     = "searching"
+	StatusMatching      = "matching"
+	StatusPendingAccept = "pending_accept"
+	StatusMatched       = "matched"
+	StatusCancelled     = "cancelled"
+	StatusFailed        = "failed"
+	StatusDeclined      = "declined"
+	StatusAbandoned     = "abandoned"
+)
+
+var ticketTransitions = map[string][]string{
+	StatusSearching:     {StatusMatching, StatusCancelled, StatusAbandoned},
+	StatusMatching:      {StatusPendingAccept, StatusMatched, StatusSearching, StatusFailed},
+	StatusPendingAccept: {StatusMatching, StatusSearching, StatusDeclined},
+}
+
+// isFinalStatus reports whether a ticket will not change its status anymore.
+func isFinalStatus(status string) bool {
+	return len(ticketTransitions[status]) == 0
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range ticketTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrTransition is returned when a ticket is not in the state a transition
+// expects, e.g. because it was cancelled or claimed concurrently.
+var ErrTransition = errors.New("ticket is not in the expected state")
+
+// ticketChannel returns the pub/sub channel on which every status change of a
+// ticket is published by the scripts below.
+func ticketChannel(ticketID string) string {
+	return "ticket:" + ticketID + ":events"
+}
+
+// Queue operations applied together with a ticket transition.
+const (
+	queueNone   = ""
+	queueRemove = "lrem"
+	queueFront  = "lpush"
+)
+
+// transitionScript moves a single ticket from ARGV[1] to ARGV[2], merging the
+// JSON object in ARGV[3] into the ticket. ARGV[4] optionally removes the ticket
+// ID (ARGV[5]) from, or pushes it to the front of, the queue in KEYS[2].
+// It returns the status the ticket had, or false if it does not exist.
+var transitionScript = redis.NewScript(`
+	local raw = redis.call("GET", KEYS[1])
+	if not raw then
+		return false
+	end
+	local t = cjson.decode(raw)
+	if t.status ~= ARGV[1] then
+		return t.status
+	end
+	t.status = ARGV[2]
+	for k, v in pairs(cjson.decode(ARGV[3])) do
+		t[k] = v
+	end
+	redis.call("SET", KEYS[1], cjson.encode(t), "KEEPTTL")
+	redis.call("PUBLISH", KEYS[1] .. ":events", t.status)
+	if ARGV[4] == "lrem" then
+		redis.call("LREM", KEYS[2], 0, ARGV[5])
+	elseif ARGV[4] == "lpush" then
+		redis.call("LPUSH", KEYS[2], ARGV[5])
+	end
+	return ARGV[1]
+`)
+
+// claimScript moves every listed ticket that is still searching and still in
+// the queue (KEYS[1]) to matching, removing it from the queue. KEYS[2..] are
+// the ticket keys, ARGV the matching ticket IDs. It returns the claimed IDs.
+var claimScript = redis.NewScript(`
+	local claimed = {}
+	for i, id in ipairs(ARGV) do
+		local raw = redis.call("GET", KEYS[i + 1])
+		if raw then
+			local t = cjson.decode(raw)
+			if t.status == "searching" and redis.call("LREM", KEYS[1], 1, id) == 1 then
+				t.status = "matching"
+				redis.call("SET", KEYS[i + 1], cjson.encode(t), "KEEPTTL")
+				redis.call("PUBLISH", KEYS[i + 1] .. ":events", t.status)
+				table.insert(claimed, id)
+			end
+		end
+	end
+	return claimed
+`)
+
+// groupTransitionScript moves all tickets in KEYS from ARGV[1] to ARGV[2], merging the
+// JSON object ARGV[i + 2] into ticket KEYS[i]. Nothing is written unless every
+// ticket is in the expected state; the key of the first offender is returned.
+var groupTransitionScript = redis.NewScript(`
+	local tickets = {}
+	for i, key in ipairs(KEYS) do
+		local raw = redis.call("GET", key)
+		if not raw then
+			return key
+		end
+		local t = cjson.decode(raw)
+		if t.status ~= ARGV[1] then
+			return key
+		end
+		tickets[i] = t
+	end
+	for i, key in ipairs(KEYS) do
+		local t = tickets[i]
+		t.status = ARGV[2]
+		for k, v in pairs(cjson.decode(ARGV[i + 2])) do
+			t[k] = v
+		end
+		redis.call("SET", key, cjson.encode(t), "KEEPTTL")
+		redis.call("PUBLISH", key .. ":events", t.status)
+	end
+	return false
+`)
+
+// transitionTicket atomically moves a ticket between two states, applying the
+// patch and the queue operation in the same step. It returns the status the
+// ticket had before, which differs from 'from' together with ErrTransition.
+func transitionTicket(ctx context.Context, ticketID string, q *QueueConfig, from, to string, patch map[string]interface{}, queueOp string) (string, error) {
+	if !canTransition(from, to) {
+		return "", fmt.Errorf("invalid ticket transition %s -> %s", from, to)
+	}
+	if patch == nil {
+		patch = map[string]interface{}{}
+	}
+	patchJSON, err := json.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+
+	queue := ""
+	if q != nil {
+		queue = q.Key()
+	}
+	prev, err := transitionScript.Run(ctx, rdb, []string{"ticket:" + ticketID, queue}, from, to, patchJSON, queueOp, ticketID).Text()
+	if err == redis.Nil {
+		return "", redis.Nil
+	} else if err != nil {
+		return "", err
+	}
+	if prev != from {
+		return prev, ErrTransition
+	}
+	return prev, nil
+}
+
+// claimTickets moves the searching tickets of a proposed group to matching and
+// returns those that were claimed. Tickets cancelled or taken by another
+// worker since the snapshot are left out.
+func claimTickets(ctx context.Context, q *QueueConfig, group []queuedTicket) ([]queuedTicket, error) {
+	keys := make([]string, 0, len(group)+1)
+	keys = append(keys, q.Key())
+	ids := make([]interface{}, len(group))
+	for i, t := range group {
+		keys = append(keys, "ticket:"+t.ID)
+		ids[i] = t.ID
+	}
+
+	claimedIDs, err := claimScript.Run(ctx, rdb, keys, ids...).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	isClaimed := make(map[string]bool, len(claimedIDs))
+	for _, id := range claimedIDs {
+		isClaimed[id] = true
+	}
+	claimed := make([]queuedTicket, 0, len(claimedIDs))
+	for _, t := range group {
+		if isClaimed[t.ID] {
+			t.Status = StatusMatching
+			claimed = append(claimed, t)
+		}
+	}
+	return claimed, nil
+}
+
+// transitionTickets atomically moves all tickets of a match from one state to
+// another, storing the per-ticket patches. No ticket is updated if any of them
+// left the expected state.
+func transitionTickets(ctx context.Context, ids []string, from, to string, patches []map[string]interface{}) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("invalid ticket transition %s -> %s", from, to)
+	}
+
+	keys := make([]string, len(ids))
+	args := make([]interface{}, 0, len(ids)+2)
+	args = append(args, from, to)
+	for i, id := range ids {
+		keys[i] = "ticket:" + id
+		patchJSON, err := json.Marshal(patches[i])
+		if err != nil {
+			return err
+		}
+		args = append(args, patchJSON)
+	}
+
+	offender, err := groupTransitionScript.Run(ctx, rdb, keys, args...).Text()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrTransition, offender)
+}
+
+// releaseTickets hands tickets in state 'from' back to the front of the queue
+// in their original order. patch is applied to each ticket; if next is not
+// StatusSearching the ticket is not queued again.
+func releaseTickets(ctx context.Context, q *QueueConfig, from string, tickets []queuedTicket, patch func(t queuedTicket) (next string, fields map[string]interface{})) error {
+	ordered := make([]queuedTicket, len(tickets))
+	copy(ordered, tickets)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].CreatedAt.Before(ordered[j].CreatedAt)
+	})
+
+	// LPUSH prepends, so push the youngest ticket first to keep the oldest at the head
+	for i := len(ordered) - 1; i >= 0; i-- {
+		t := ordered[i]
+		next, fields := StatusSearching, map[string]interface{}(nil)
+		if patch != nil {
+			next, fields = patch(t)
+		}
+		op := queueFront
+		if next != StatusSearching {
+			op = queueNone
+		}
+		_, err := transitionTicket(ctx, t.ID, q, from, next, fields, op)
+		if err != nil && err != redis.Nil && !errors.Is(err, ErrTransition) {
+			return err
+		}
+	}
+
+	if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+		queueSize.WithLabelValues(q.Name).Set(float64(size))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// streamKeepAlive is how often an idle stream sends a comment so that proxies
+// do not close the connection.
+const streamKeepAlive = 15 * time.Second
+
+// handleStream pushes the status of a ticket as Server-Sent Events. It sends
+// the current status right away and then every change published by the state
+// scripts, and ends the stream once the ticket reaches a final status. The
+// events carry the same JSON as /matchmaking/status. An open stream keeps the
+// ticket's heartbeat alive like polling the status does.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticketID, ok := requestedTicketID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	// Subscribe before reading the ticket so that no change in between is lost
+	sub := rdb.Subscribe(ctx, ticketChannel(ticketID))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := ticketStatus(ctx, ticketID)
+	if err == redis.Nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errCorruptTicket) {
+		http.Error(w, "Data corruption", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("Redis error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Streams outlive any write timeout meant for ordinary requests
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	statusStreams.Inc()
+	defer statusStreams.Dec()
+
+	last := ""
+	send := func(response map[string]interface{}) error {
+		status, _ := response["status"].(string)
+		if status == last {
+			return nil
+		}
+		last = status
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		statusEvents.Inc()
+		return rc.Flush()
+	}
+
+	if err := send(response); err != nil || isFinalStatus(last) {
+		return
+	}
+	heartbeat := func() {
+		if err := touchTicket(ctx, ticketID); err != nil && err != redis.Nil && ctx.Err() == nil {
+			log.Printf("Heartbeat for ticket %s failed: %v", ticketID, err)
+		}
+	}
+	heartbeat()
+
+	// Refresh the heartbeat well before it runs out, even with a short timeout
+	keepAlive := time.NewTicker(min(streamKeepAlive, time.Duration(config.Tickets.HeartbeatTimeout)/3))
+	defer keepAlive.Stop()
+
+	events := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			heartbeat()
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			// The event only carries the status; read the ticket for the full response
+			response, err := ticketStatus(ctx, ticketID)
+			if err != nil {
+				if err != redis.Nil && ctx.Err() == nil {
+					log.Printf("Reading ticket %s for stream failed: %v", ticketID, err)
+				}
+				return
+			}
+			if err := send(response); err != nil || isFinalStatus(last) {
+				return
+			}
+		}
+	}
+}
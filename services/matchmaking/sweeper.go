@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Reasons a ticket is reaped from the queue.
+const (
+	reapExpired   = "expired"   // the ticket data expired, only the ID was left in the queue
+	reapAbandoned = "abandoned" // the client stopped asking for the ticket's status
+)
+
+// TicketConfig controls how long tickets stay queued without a client.
+type TicketConfig struct {
+	// HeartbeatTimeout is how long a searching ticket stays queued after the
+	// last status poll or stream update for it.
+	HeartbeatTimeout Duration `json:"heartbeatTimeout"`
+	// SweepInterval is how often the worker of a queue sweeps it.
+	SweepInterval Duration `json:"sweepInterval"`
+}
+
+// heartbeatKey exists for as long as the client of a ticket is alive.
+func heartbeatKey(ticketID string) string {
+	return "ticket:" + ticketID + ":heartbeat"
+}
+
+// touchTicket records a heartbeat for a ticket that has not reached a final
+// status yet, and keeps its data from expiring while the client waits.
+func touchTicket(ctx context.Context, ticketID string) error {
+	val, err := rdb.Get(ctx, "ticket:"+ticketID).Result()
+	if err != nil {
+		return err
+	}
+	var ticket Ticket
+	if err := json.Unmarshal([]byte(val), &ticket); err != nil {
+		return err
+	}
+	if isFinalStatus(ticket.Status) {
+		return nil
+	}
+
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, heartbeatKey(ticketID), 1, time.Duration(config.Tickets.HeartbeatTimeout))
+	pipe.Expire(ctx, "ticket:"+ticketID, ticketTTL)
+	for _, p := range ticket.Players {
+		pipe.Expire(ctx, playerTicketKey(p.PlayerID), ticketTTL)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// aliveTickets returns the tickets whose client sent a heartbeat recently.
+func aliveTickets(ctx context.Context, tickets []queuedTicket) ([]queuedTicket, error) {
+	if len(tickets) == 0 {
+		return tickets, nil
+	}
+
+	pipe := rdb.Pipeline()
+	beats := make([]*redis.IntCmd, len(tickets))
+	for i, t := range tickets {
+		beats[i] = pipe.Exists(ctx, heartbeatKey(t.ID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	alive := tickets[:0]
+	for i, t := range tickets {
+		if beats[i].Val() == 1 {
+			alive = append(alive, t)
+		}
+	}
+	return alive, nil
+}
+
+// missingTickets returns the IDs of tickets in the group whose data no longer exists.
+func missingTickets(ctx context.Context, group []queuedTicket) ([]string, error) {
+	pipe := rdb.Pipeline()
+	exists := make([]*redis.IntCmd, len(group))
+	for i, t := range group {
+		exists[i] = pipe.Exists(ctx, "ticket:"+t.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for i, t := range group {
+		if exists[i].Val() == 0 {
+			missing = append(missing, t.ID)
+		}
+	}
+	return missing, nil
+}
+
+// sweepQueue reaps tickets from the queue: IDs whose ticket data expired are
+// removed, and searching tickets without a recent heartbeat end as abandoned.
+func sweepQueue(ctx context.Context, q *QueueConfig) error {
+	ids, err := rdb.LRange(ctx, q.Key(), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	pipe := rdb.Pipeline()
+	exists := make([]*redis.IntCmd, len(ids))
+	beats := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		exists[i] = pipe.Exists(ctx, "ticket:"+id)
+		beats[i] = pipe.Exists(ctx, heartbeatKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	reaped := 0
+	for i, id := range ids {
+		switch {
+		case exists[i].Val() == 0:
+			// Nothing can bring the data back, so the ID can go without a transition
+			if err := rdb.LRem(ctx, q.Key(), 0, id).Err(); err != nil {
+				return err
+			}
+			ticketsReaped.WithLabelValues(q.Name, reapExpired).Inc()
+			reaped++
+		case beats[i].Val() == 0:
+			patch := map[string]interface{}{"failureReason": "no status requests for " + config.Tickets.HeartbeatTimeout.String()}
+			_, err := transitionTicket(ctx, id, q, StatusSearching, StatusAbandoned, patch, queueRemove)
+			if errors.Is(err, ErrTransition) || err == redis.Nil {
+				// Claimed, cancelled or expired since the scan
+				continue
+			} else if err != nil {
+				return err
+			}
+			ticketsReaped.WithLabelValues(q.Name, reapAbandoned).Inc()
+			reaped++
+		}
+	}
+
+	if reaped > 0 {
+		log.Printf("[%s] Reaped %d stale tickets", q.Name, reaped)
+		if size, err := rdb.LLen(ctx, q.Key()).Result(); err == nil {
+			queueSize.WithLabelValues(q.Name).Set(float64(size))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+type Team struct {
+	Players        []string `json:"players"`
+	Rating         float64  `json:"rating"` // average rating of the team
+	WinProbability float64  `json:"winProbability"`
+	// Role per player ID in role queues
+	Roles map[string]string `json:"roles,omitempty"`
+}
+
+// balanceTeams splits the tickets into teamCount teams of teamSize players so
+// that the gap between the highest and lowest average team rating is as small
+// as possible. Party tickets are never split. The search is exhaustive, which
+// is cheap for the handful of tickets that make up a single match. With roles,
+// only splits where every team can fill the role composition are considered.
+// It returns the tickets per team, or nil if the tickets cannot be packed.
+func balanceTeams(tickets []queuedTicket, teamCount, teamSize int, roles *RoleConfig) [][]queuedTicket {
+	order := make([]int, len(tickets))
+	for i := range order {
+		order[i] = i
+	}
+	// Placing big parties first prunes the search early.
+	sort.SliceStable(order, func(a, b int) bool {
+		return tickets[order[a]].Size() > tickets[order[b]].Size()
+	})
+
+	ratings := make([]float64, len(tickets))
+	for i, t := range tickets {
+		for _, p := range t.Players {
+			ratings[i] += p.Rating
+		}
+	}
+
+	assign := make([]int, len(tickets))
+	best := make([]int, len(tickets))
+	bestGap := math.Inf(1)
+	fill := make([]int, teamCount)
+	sum := make([]float64, teamCount)
+
+	var search func(k int)
+	search = func(k int) {
+		if k == len(order) {
+			for _, f := range fill {
+				if f != teamSize {
+					return
+				}
+			}
+			lo, hi := math.Inf(1), math.Inf(-1)
+			for _, s := range sum {
+				avg := s / float64(teamSize)
+				lo = math.Min(lo, avg)
+				hi = math.Max(hi, avg)
+			}
+			if hi-lo < bestGap && (roles == nil || teamsFillRoles(tickets, assign, teamCount, roles)) {
+				bestGap = hi - lo
+				copy(best, assign)
+			}
+			return
+		}
+
+		idx := order[k]
+		size := tickets[idx].Size()
+		for team := 0; team < teamCount; team++ {
+			if fill[team]+size > teamSize {
+				continue
+			}
+			assign[idx] = team
+			fill[team] += size
+			sum[team] += ratings[idx]
+			search(k + 1)
+			fill[team] -= size
+			sum[team] -= ratings[idx]
+
+			// Teams are interchangeable, so an empty team only needs to be tried once.
+			if fill[team] == 0 {
+				break
+			}
+		}
+	}
+	search(0)
+
+	if math.IsInf(bestGap, 1) {
+		return nil
+	}
+
+	teams := make([][]queuedTicket, teamCount)
+	for i, t := range tickets {
+		teams[best[i]] = append(teams[best[i]], t)
+	}
+	return teams
+}
+
+// teamsFillRoles reports whether every team of the assignment can fill the
+// role composition on its own.
+func teamsFillRoles(tickets []queuedTicket, assign []int, teamCount int, roles *RoleConfig) bool {
+	for team := 0; team < teamCount; team++ {
+		var members []queuedTicket
+		for i, t := range tickets {
+			if assign[i] == team {
+				members = append(members, t)
+			}
+		}
+		if !roles.fits(members, 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildTeams converts balanced ticket groups into the Team records stored on
+// a match, including the predicted chance of each team winning and, with
+// roles, the role each player takes.
+func buildTeams(groups [][]queuedTicket, roles *RoleConfig) []Team {
+	teams := make([]Team, len(groups))
+	for i, g := range groups {
+		var sum float64
+		var players []string
+		for _, t := range g {
+			for _, p := range t.Players {
+				players = append(players, p.PlayerID)
+				sum += p.Rating
+			}
+		}
+		teams[i] = Team{Players: players}
+		if len(players) > 0 {
+			teams[i].Rating = sum / float64(len(players))
+		}
+		if roles != nil {
+			teams[i].Roles = assignRoles(g, roles.slots(1))
+		}
+	}
+
+	// Bradley-Terry on the Elo scale; reduces to the usual Elo expectation for two teams.
+	var total float64
+	strength := make([]float64, len(teams))
+	for i, t := range teams {
+		strength[i] = math.Pow(10, t.Rating/400)
+		total += strength[i]
+	}
+	for i := range teams {
+		teams[i].WinProbability = strength[i] / total
+	}
+	return teams
+}
+
+// teamRatingGap returns the difference between the strongest and weakest team.
+func teamRatingGap(teams []Team) float64 {
+	if len(teams) == 0 {
+		return 0
+	}
+	lo, hi := teams[0].Rating, teams[0].Rating
+	for _, t := range teams[1:] {
+		lo = math.Min(lo, t.Rating)
+		hi = math.Max(hi, t.Rating)
+	}
+	return hi - lo
+}
+
+// favouriteWinProbability returns the win probability of the strongest team.
+func favouriteWinProbability(teams []Team) float64 {
+	var p float64
+	for _, t := range teams {
+		p = math.Max(p, t.WinProbability)
+	}
+	return p
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBalanceTeams(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name      string
+		tickets   []queuedTicket
+		teamCount int
+		teamSize  int
+		want      [][]string // ticket IDs per team, in any team order
+	}{
+		{
+			name: "solos",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1000), testTicket("b", now, 1100),
+				testTicket("c", now, 1200), testTicket("d", now, 1300),
+			},
+			teamCount: 2, teamSize: 2,
+			want: [][]string{{"a", "d"}, {"b", "c"}},
+		},
+		{
+			name: "party stays together",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1000, 1100), testTicket("c", now, 1200), testTicket("d", now, 1300),
+			},
+			teamCount: 2, teamSize: 2,
+			want: [][]string{{"a"}, {"c", "d"}},
+		},
+		{
+			name: "three teams",
+			tickets: []queuedTicket{
+				testTicket("a", now, 1000), testTicket("b", now, 1100), testTicket("c", now, 1200),
+				testTicket("d", now, 1300), testTicket("e", now, 1400), testTicket("f", now, 1500),
+			},
+			teamCount: 3, teamSize: 2,
+			want: [][]string{{"a", "f"}, {"b", "e"}, {"c", "d"}},
+		},
+		{
+			name:      "party too big for a team",
+			tickets:   []queuedTicket{testTicket("a", now, 1000, 1000, 1000), testTicket("b", now, 1000)},
+			teamCount: 2, teamSize: 2,
+		},
+		{
+			name:      "too few players",
+			tickets:   []queuedTicket{testTicket("a", now, 1000), testTicket("b", now, 1000), testTicket("c", now, 1000)},
+			teamCount: 2, teamSize: 2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			teams := balanceTeams(tt.tickets, tt.teamCount, tt.teamSize, nil)
+			if tt.want == nil {
+				if teams != nil {
+					t.Fatalf("got %v, want no teams", teams)
+				}
+				return
+			}
+			var got [][]string
+			for _, team := range teams {
+				got = append(got, ticketIDs(team))
+			}
+			slices.SortFunc(got, slices.Compare)
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
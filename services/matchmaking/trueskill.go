@@ -0,0 +1,153 @@
+package main
+
+import "math"
+
+// trueSkill rates teams with TrueSkill on the scale of the stored ratings: the
+// default rating and uncertainty are the prior mean and deviation, and beta
+// and tau follow the proportions of the original defaults (25, 25/3, 25/6,
+// 25/300). Two teams are updated exactly; with more teams every pair of teams
+// is updated as its own two-team game and the changes are averaged, which
+// approximates the full factor graph.
+type trueSkill struct {
+	beta            float64 // performance variation of a single player
+	tau             float64 // dynamics added to the uncertainty before every match
+	drawProbability float64
+}
+
+func newTrueSkill(drawProbability float64) trueSkill {
+	return trueSkill{
+		beta:            defaultUncertainty / 2,
+		tau:             defaultUncertainty / 100,
+		drawProbability: drawProbability,
+	}
+}
+
+func (ts trueSkill) Update(teams [][]Rating, ranks []int) [][]Rating {
+	// Uncertainty grows a little before every match so ratings never freeze
+	variances := make([][]float64, len(teams))
+	for i, team := range teams {
+		variances[i] = make([]float64, len(team))
+		for p, r := range team {
+			variances[i][p] = r.Uncertainty*r.Uncertainty + ts.tau*ts.tau
+		}
+	}
+
+	opponents := float64(len(teams) - 1)
+	meanDelta := make([][]float64, len(teams))
+	varianceFactor := make([][]float64, len(teams))
+	for i, team := range teams {
+		meanDelta[i] = make([]float64, len(team))
+		varianceFactor[i] = make([]float64, len(team))
+		for p := range team {
+			varianceFactor[i][p] = 1
+		}
+	}
+
+	for i := range teams {
+		for j := i + 1; j < len(teams); j++ {
+			var muI, muJ, c2 float64
+			for p, r := range teams[i] {
+				muI += r.Rating
+				c2 += variances[i][p]
+			}
+			for p, r := range teams[j] {
+				muJ += r.Rating
+				c2 += variances[j][p]
+			}
+			players := float64(len(teams[i]) + len(teams[j]))
+			c2 += players * ts.beta * ts.beta
+			c := math.Sqrt(c2)
+			epsilon := ts.drawMargin(players) / c
+
+			// v and w are seen from team i; the winner's view is mirrored for team j
+			var v, w float64
+			switch {
+			case ranks[i] < ranks[j]:
+				v, w = vWin((muI-muJ)/c, epsilon), wWin((muI-muJ)/c, epsilon)
+			case ranks[i] > ranks[j]:
+				v, w = vWin((muJ-muI)/c, epsilon), wWin((muJ-muI)/c, epsilon)
+				v = -v
+			default:
+				v, w = vDraw((muI-muJ)/c, epsilon), wDraw((muI-muJ)/c, epsilon)
+			}
+
+			for p := range teams[i] {
+				meanDelta[i][p] += variances[i][p] / c * v
+				varianceFactor[i][p] *= math.Pow(1-variances[i][p]/c2*w, 1/opponents)
+			}
+			for p := range teams[j] {
+				meanDelta[j][p] -= variances[j][p] / c * v
+				varianceFactor[j][p] *= math.Pow(1-variances[j][p]/c2*w, 1/opponents)
+			}
+		}
+	}
+
+	updated := make([][]Rating, len(teams))
+	for i, team := range teams {
+		updated[i] = make([]Rating, len(team))
+		for p, r := range team {
+			r.Rating += meanDelta[i][p] / opponents
+			r.Uncertainty = math.Sqrt(variances[i][p] * varianceFactor[i][p])
+			updated[i][p] = r
+		}
+	}
+	return updated
+}
+
+// drawMargin returns the performance difference below which a game between
+// teams with the given number of players ends in a draw.
+func (ts trueSkill) drawMargin(players float64) float64 {
+	return normalQuantile((ts.drawProbability+1)/2) * math.Sqrt(players) * ts.beta
+}
+
+// vWin and wWin are the mean and variance corrections for a win, with t the
+// normalised performance lead of the winner and epsilon the draw margin.
+func vWin(t, epsilon float64) float64 {
+	denom := normalCDF(t - epsilon)
+	if denom < 1e-12 {
+		// Limit for a very unexpected win
+		return -(t - epsilon)
+	}
+	return normalPDF(t-epsilon) / denom
+}
+
+func wWin(t, epsilon float64) float64 {
+	if normalCDF(t-epsilon) < 1e-12 {
+		return 1
+	}
+	v := vWin(t, epsilon)
+	return v * (v + t - epsilon)
+}
+
+// vDraw and wDraw are the corrections for a draw.
+func vDraw(t, epsilon float64) float64 {
+	denom := normalCDF(epsilon-t) - normalCDF(-epsilon-t)
+	if denom < 1e-12 {
+		if t < 0 {
+			return -t - epsilon
+		}
+		return -t + epsilon
+	}
+	return (normalPDF(-epsilon-t) - normalPDF(epsilon-t)) / denom
+}
+
+func wDraw(t, epsilon float64) float64 {
+	denom := normalCDF(epsilon-t) - normalCDF(-epsilon-t)
+	if denom < 1e-12 {
+		return 1
+	}
+	v := vDraw(t, epsilon)
+	return v*v + ((epsilon-t)*normalPDF(epsilon-t)-(-epsilon-t)*normalPDF(-epsilon-t))/denom
+}
+
+func normalPDF(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+func normalCDF(x float64) float64 {
+	return math.Erfc(-x/math.Sqrt2) / 2
+}
+
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
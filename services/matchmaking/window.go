@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// WindowCurve describes how an allowance of a ticket, such as the rating
+// spread or the ping to the server region, grows with the time it has spent
+// in the queue.
+//
+//   - linear:      Initial + Growth * seconds waited
+//   - step:        Initial + Growth * completed StepEvery intervals
+//   - exponential: Initial * (1 + Growth) ^ seconds waited
+//
+// The result never exceeds Max.
+type WindowCurve struct {
+	Kind      string   `json:"kind"`
+	Initial   float64  `json:"initial"`
+	Max       float64  `json:"max"`
+	Growth    float64  `json:"growth"`
+	StepEvery Duration `json:"stepEvery,omitempty"`
+}
+
+// At returns the allowance after waiting for the given duration.
+func (c WindowCurve) At(wait time.Duration) float64 {
+	if wait < 0 {
+		wait = 0
+	}
+	secs := wait.Seconds()
+
+	var w float64
+	switch c.Kind {
+	case "step":
+		steps := 0.0
+		if c.StepEvery > 0 {
+			steps = math.Floor(float64(wait) / float64(c.StepEvery))
+		}
+		w = c.Initial + c.Growth*steps
+	case "exponential":
+		w = c.Initial * math.Pow(1+c.Growth, secs)
+	default:
+		w = c.Initial + c.Growth*secs
+	}
+
+	return math.Min(w, c.Max)
+}
+
+func (c WindowCurve) validate() error {
+	switch c.Kind {
+	case "linear":
+	case "exponential":
+		// The window grows by a factor of itself, so it never leaves zero
+		if c.Initial <= 0 {
+			return fmt.Errorf("exponential curve needs a positive initial window")
+		}
+	case "step":
+		if c.StepEvery <= 0 {
+			return fmt.Errorf("step curve needs a positive step interval")
+		}
+	default:
+		return fmt.Errorf("unknown window curve %q", c.Kind)
+	}
+	if c.Initial < 0 || c.Growth < 0 {
+		return fmt.Errorf("window curve values must not be negative")
+	}
+	if c.Max <= 0 {
+		return fmt.Errorf("window curve needs a positive maximum")
+	}
+	if c.Max < c.Initial {
+		return fmt.Errorf("window maximum %.0f is below the initial window %.0f", c.Max, c.Initial)
+	}
+	return nil
+}
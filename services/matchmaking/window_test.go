@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWindowCurveAt(t *testing.T) {
+	linear := WindowCurve{Kind: "linear", Initial: 100, Growth: 10, Max: 500}
+	step := WindowCurve{Kind: "step", Initial: 100, Growth: 50, Max: 300, StepEvery: Duration(10 * time.Second)}
+	exponential := WindowCurve{Kind: "exponential", Initial: 100, Growth: 0.1, Max: 1000}
+
+	for _, tt := range []struct {
+		name  string
+		curve WindowCurve
+		wait  time.Duration
+		want  float64
+	}{
+		{"linear at start", linear, 0, 100},
+		{"linear growing", linear, 5 * time.Second, 150},
+		{"linear capped", linear, time.Minute, 500},
+		{"linear negative wait", linear, -time.Second, 100},
+		{"step before first step", step, 9 * time.Second, 100},
+		{"step after first step", step, 10 * time.Second, 150},
+		{"step between steps", step, 25 * time.Second, 200},
+		{"step capped", step, time.Hour, 300},
+		{"exponential at start", exponential, 0, 100},
+		{"exponential after a second", exponential, time.Second, 110},
+		{"exponential after two seconds", exponential, 2 * time.Second, 121},
+		{"exponential capped", exponential, time.Hour, 1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.curve.At(tt.wait); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("At(%v) = %v, want %v", tt.wait, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowCurveValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		curve WindowCurve
+		valid bool
+	}{
+		{"linear", WindowCurve{Kind: "linear", Initial: 100, Growth: 10, Max: 500}, true},
+		{"linear from zero", WindowCurve{Kind: "linear", Growth: 10, Max: 500}, true},
+		{"step", WindowCurve{Kind: "step", Initial: 100, Growth: 50, Max: 300, StepEvery: Duration(time.Second)}, true},
+		{"exponential", WindowCurve{Kind: "exponential", Initial: 100, Growth: 0.1, Max: 1000}, true},
+		{"unknown kind", WindowCurve{Kind: "cubic", Initial: 100, Max: 500}, false},
+		{"no kind", WindowCurve{Initial: 100, Max: 500}, false},
+		{"exponential from zero", WindowCurve{Kind: "exponential", Growth: 0.1, Max: 1000}, false},
+		{"step without interval", WindowCurve{Kind: "step", Initial: 100, Growth: 50, Max: 300}, false},
+		{"negative initial", WindowCurve{Kind: "linear", Initial: -1, Max: 500}, false},
+		{"negative growth", WindowCurve{Kind: "linear", Initial: 100, Growth: -1, Max: 500}, false},
+		{"no maximum", WindowCurve{Kind: "linear", Initial: 100, Growth: 10}, false},
+		{"maximum below initial", WindowCurve{Kind: "linear", Initial: 100, Growth: 10, Max: 50}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.curve.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}